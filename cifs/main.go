@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
+
+	"github.com/golang/glog"
 
 	"github.com/alternative-storage/cifs-csi/pkg/cifs"
 )
@@ -15,12 +18,66 @@ var (
 	endpoint   = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	driverName = flag.String("drivername", "csi-cifsplugin", "name of the driver")
 	nodeId     = flag.String("nodeid", "", "node id")
+
+	adminSecrets      = flag.String("adminsecrets", "", "directory of the admin_name and admin_password files used by RPCs which carry no secrets, GetCapacity and the ListVolumes cross-check")
+	crossCheckVolumes = flag.Bool("crosscheckvolumes", false, "leave volumes whose share no longer exists out of ListVolumes, requires -adminsecrets")
+
+	orphanInterval    = flag.Duration("orphaninterval", 0, "interval at which orphaned shares are looked for, 0 disables it, requires -adminsecrets")
+	orphanGracePeriod = flag.Duration("orphangraceperiod", time.Hour, "how long a share has to be orphaned before it is reported or removed")
+	orphanRemove      = flag.Bool("orphanremove", false, "remove orphaned shares instead of only reporting them, requires -orphancheckpvs")
+	orphanCheckPVs    = flag.Bool("orphancheckpvs", false, "also keep the shares of the PersistentVolumes of the driver, requires running in a Kubernetes cluster")
+
+	controllerCache = flag.String("controllercache", "file", "where the volume and snapshot caches of the controller are stored, file for the plugin directory of the node or configmap for ConfigMaps")
+	cacheNamespace  = flag.String("cachenamespace", "default", "namespace of the controller cache ConfigMaps")
+	migrateCache    = flag.Bool("migratecache", false, "import the volume and snapshot cache files of this node into ConfigMaps and exit")
+
+	krb5RenewInterval = flag.Duration("krb5renewinterval", time.Hour, "interval at which the Kerberos tickets of sec=krb5 mounts are renewed, shorter than their lifetime")
+
+	commandTimeouts = flag.String("commandtimeouts", "", "comma separated COMMAND=DURATION timeouts of the commands run by the driver overriding the defaults, such as net=30s,cp=1h")
 )
 
 func main() {
 	flag.Parse()
+
+	if err := cifs.SetCommandTimeouts(*commandTimeouts); err != nil {
+		glog.Fatalf("invalid -commandtimeouts: %v", err)
+	}
+
+	if *migrateCache {
+		n, err := cifs.MigrateControllerCache(*cacheNamespace)
+		if err != nil {
+			glog.Fatalf("failed to migrate the controller cache: %v", err)
+		}
+		glog.Infof("migrated %d controller cache entries to namespace %s", n, *cacheNamespace)
+		os.Exit(0)
+	}
+
 	driver := cifs.NewCifsDriver()
 	driver.Init(*driverName, *nodeId)
+	switch *controllerCache {
+	case "file":
+	case "configmap":
+		if err := driver.UseConfigMapControllerCache(*cacheNamespace); err != nil {
+			glog.Fatalf("failed to load the controller cache from ConfigMaps: %v", err)
+		}
+	default:
+		glog.Fatalf("unknown controller cache %q, supported caches are file and configmap", *controllerCache)
+	}
+	if *krb5RenewInterval <= 0 {
+		glog.Fatalf("invalid -krb5renewinterval %v", *krb5RenewInterval)
+	}
+	driver.SetKerberosRenewInterval(*krb5RenewInterval)
+	if *adminSecrets != "" {
+		driver.SetAdminSecretsDir(*adminSecrets)
+	}
+	if *crossCheckVolumes {
+		driver.EnableListVolumesCrossCheck()
+	}
+	if *orphanInterval > 0 {
+		if err := driver.EnableOrphanReconciler(*orphanInterval, *orphanGracePeriod, *orphanRemove, *orphanCheckPVs); err != nil {
+			glog.Fatalf("failed to enable the orphaned share reconciler: %v", err)
+		}
+	}
 	driver.Start(*endpoint)
 	os.Exit(0)
 }
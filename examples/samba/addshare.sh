@@ -2,6 +2,10 @@
 
 # usage:
 #  net rpc share add $SHARE_NAME=$PATH_TO_SHARE $COMMENT
+#
+# With `registry shares = yes`, the share is created in the registry, so
+# that options such as the dfree command can be set with `net rpc conf`.
+# Otherwise it is created as a usershare.
 
 config_file=$1
 share_name=$2
@@ -17,4 +21,13 @@ else
     echo "$path_name already exists"
 fi
 
-net usershare add $share_name $share_path $comment -M $maxconnections
+registry_shares=$(testparm -s --parameter-name="registry shares" "$config_file" 2>/dev/null)
+
+case "$registry_shares" in
+    [Yy]es)
+        net conf addshare $share_name $share_path writeable=y guest_ok=n "$comment"
+        ;;
+    *)
+        net usershare add $share_name $share_path $comment -M $maxconnections
+        ;;
+esac
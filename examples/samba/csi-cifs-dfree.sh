@@ -0,0 +1,26 @@
+#!/bin/sh
+
+# usage:
+#  dfree command = /usr/local/bin/csi-cifs-dfree $SIZE_IN_BYTES
+#
+# Samba appends the directory being queried and expects the total and
+# available space in 1K blocks.
+
+size=$1
+dir=$2
+
+if [ "$size" = "" ] || [ "$dir" = "" ]
+then
+    exit 1
+fi
+
+total=$((size / 1024))
+used=$(du -sk "$dir" | cut -f1)
+avail=$((total - used))
+
+if [ $avail -lt 0 ]
+then
+    avail=0
+fi
+
+echo "$total $avail"
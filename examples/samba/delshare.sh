@@ -10,6 +10,12 @@ then
     exit 1
 fi
 
+if net conf showshare $share_name > /dev/null 2>&1
+then
+    net conf delshare $share_name
+    exit $?
+fi
+
 if ! net usershare info $share_name > /dev/null
 then
     exit 1
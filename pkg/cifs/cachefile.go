@@ -0,0 +1,120 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// cacheTempFilePrefix is the prefix of the temporary files cache entries
+	// are written to before being renamed to their final name
+	cacheTempFilePrefix = ".tmp-"
+
+	// cacheQuarantineDir is the directory within a cache directory to which
+	// unreadable entries are moved
+	cacheQuarantineDir = "quarantine"
+)
+
+// writeFileAtomic writes data to filePath so that either the previous or the
+// new contents are found after a crash: data is written to a temporary file in
+// the same directory, synced and renamed over filePath, and the directory
+// is synced.
+func writeFileAtomic(filePath string, data []byte) error {
+	dir, name := filepath.Split(filePath)
+
+	f, err := ioutil.TempFile(dir, cacheTempFilePrefix+name+"-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// loadCacheDir calls load with the contents of each .json file in the cache
+// directory root. Files which can't be read or loaded are moved to the
+// quarantine directory of the cache, and temporary files left behind by
+// interrupted writes are removed.
+func loadCacheDir(root string, load func(data []byte) error) error {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		filePath := path.Join(root, fi.Name())
+
+		if strings.HasPrefix(fi.Name(), cacheTempFilePrefix) {
+			glog.Warningf("cifs: removing interrupted cache write %s", filePath)
+			if err = os.Remove(filePath); err != nil {
+				glog.Errorf("cifs: failed to remove %s: %v", filePath, err)
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filePath)
+		if err == nil {
+			err = load(data)
+		}
+		if err != nil {
+			glog.Errorf("cifs: failed to load cache entry %s: %v", filePath, err)
+			quarantineCacheFile(root, fi.Name())
+		}
+	}
+
+	return nil
+}
+
+// quarantineCacheFile moves the cache entry file name of the cache directory
+// root to its quarantine directory, so that it can be inspected and repaired.
+func quarantineCacheFile(root, name string) {
+	dir := path.Join(root, cacheQuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		glog.Errorf("cifs: failed to create quarantine directory %s: %v", dir, err)
+		return
+	}
+
+	if err := os.Rename(path.Join(root, name), path.Join(dir, name)); err != nil {
+		glog.Errorf("cifs: failed to quarantine cache entry %s: %v", name, err)
+		return
+	}
+
+	glog.Warningf("cifs: moved cache entry %s to %s", name, dir)
+}
@@ -0,0 +1,142 @@
+package cifs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "entry.json")
+	for _, data := range []string{"first", "second"} {
+		if err = writeFileAtomic(filePath, []byte(data)); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(b) != data {
+			t.Errorf("expected %q, but got %q", data, string(b))
+		}
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("expected no temporary files to be left, but got %d files", len(fis))
+	}
+}
+
+func TestLoadCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ent := &controllerCacheEntry{VolumeID: "csi-cifs-testvol", VolumeName: "testvol", CapacityBytes: oneGB, Version: controllerCacheEntryVersion}
+	if ent.Checksum, err = ent.checksum(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	valid, _ := json.Marshal(ent)
+
+	corrupted := *ent
+	corrupted.CapacityBytes = 2 * oneGB
+	modified, _ := json.Marshal(&corrupted)
+
+	files := map[string]string{
+		"valid.json":              string(valid),
+		"legacy.json":             `{"VolumeID":"csi-cifs-legacy","VolumeName":"legacy"}`,
+		"truncated.json":          string(valid[:len(valid)/2]),
+		"modified.json":           string(modified),
+		cacheTempFilePrefix + "x": "",
+		"README":                  "",
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	loaded := make(map[volumeID]bool)
+	err = loadCacheDir(dir, func(data []byte) error {
+		ent := &controllerCacheEntry{}
+		if err := json.Unmarshal(data, ent); err != nil {
+			return err
+		}
+		if err := ent.verify(); err != nil {
+			return err
+		}
+
+		loaded[ent.VolumeID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !loaded["csi-cifs-testvol"] || !loaded["csi-cifs-legacy"] || len(loaded) != 2 {
+		t.Errorf("expected the valid and legacy entries to be loaded, but got %v", loaded)
+	}
+
+	tests := []struct {
+		name   string
+		dir    string
+		exists bool
+	}{
+		{name: "valid.json", dir: dir, exists: true},
+		{name: "README", dir: dir, exists: true},
+		{name: cacheTempFilePrefix + "x", dir: dir, exists: false},
+		{name: "truncated.json", dir: dir, exists: false},
+		{name: "truncated.json", dir: filepath.Join(dir, cacheQuarantineDir), exists: true},
+		{name: "modified.json", dir: filepath.Join(dir, cacheQuarantineDir), exists: true},
+	}
+
+	for _, tc := range tests {
+		if _, err := os.Stat(filepath.Join(tc.dir, tc.name)); (err == nil) != tc.exists {
+			t.Errorf("expected %s to exist in %s: %v, but got %v", tc.name, tc.dir, tc.exists, err)
+		}
+	}
+}
+
+func TestControllerCacheEntryVerify(t *testing.T) {
+	ent := controllerCacheEntry{VolumeID: "csi-cifs-testvol", Version: controllerCacheEntryVersion}
+	sum, err := ent.checksum()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		ent    controllerCacheEntry
+		errors bool
+	}{
+		{name: "Valid", ent: controllerCacheEntry{VolumeID: "csi-cifs-testvol", Version: controllerCacheEntryVersion, Checksum: sum}, errors: false},
+		{name: "Legacy", ent: controllerCacheEntry{VolumeID: "csi-cifs-testvol"}, errors: false},
+		{name: "Fail due to checksum mismatch", ent: controllerCacheEntry{VolumeID: "csi-cifs-other", Version: controllerCacheEntryVersion, Checksum: sum}, errors: true},
+		{name: "Fail due to missing checksum", ent: controllerCacheEntry{VolumeID: "csi-cifs-testvol", Version: controllerCacheEntryVersion}, errors: true},
+		{name: "Fail due to unknown version", ent: controllerCacheEntry{VolumeID: "csi-cifs-testvol", Version: controllerCacheEntryVersion + 1, Checksum: sum}, errors: true},
+	}
+
+	for _, tc := range tests {
+		err := tc.ent.verify()
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cifs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
+)
+
+const (
+	// capacityCacheTTL is how long the capacity of a server is cached,
+	// since probing it may mount a share
+	capacityCacheTTL = 30 * time.Second
+
+	// capacityShareParam is the StorageClass parameter naming a share of the
+	// server which is mounted to measure the free space of a net share manager
+	capacityShareParam = "capacityShare"
+)
+
+// capacityKey identifies the filesystem whose free space is reported for a set of volume options.
+type capacityKey struct {
+	shareManager  string
+	server        string
+	share         string
+	path          string
+	capacityShare string
+}
+
+type capacityCacheEntry struct {
+	availableBytes int64
+	expires        time.Time
+}
+
+var (
+	capCache    = make(map[capacityKey]capacityCacheEntry)
+	capCacheMtx sync.Mutex
+)
+
+// getCapacity returns the space available for new volumes with volOptions.
+// The space is measured on the mounted capacityShare if it is not empty, or
+// on the filesystem of the directory under which subdirectory shares are
+// created, and cached for capacityCacheTTL.
+func (cs *controllerServer) getCapacity(ctx context.Context, volOptions *volumeOptions, capacityShare string) (int64, error) {
+	key := capacityKey{
+		shareManager:  volOptions.ShareManager,
+		server:        volOptions.Server,
+		share:         volOptions.Share,
+		path:          volOptions.Path,
+		capacityShare: capacityShare,
+	}
+
+	capCacheMtx.Lock()
+	ent, ok := capCache[key]
+	capCacheMtx.Unlock()
+
+	if ok && time.Now().Before(ent.expires) {
+		return ent.availableBytes, nil
+	}
+
+	bytes, err := cs.probeCapacity(ctx, volOptions, capacityShare)
+	if err != nil {
+		return 0, err
+	}
+
+	capCacheMtx.Lock()
+	capCache[key] = capacityCacheEntry{availableBytes: bytes, expires: time.Now().Add(capacityCacheTTL)}
+	capCacheMtx.Unlock()
+
+	return bytes, nil
+}
+
+func (cs *controllerServer) probeCapacity(ctx context.Context, volOptions *volumeOptions, capacityShare string) (int64, error) {
+	// Shares are mounted with the admin credentials
+	cr, err := cs.getAdminSecretsDirCredentials()
+	if err != nil {
+		return 0, err
+	}
+
+	var available int64
+	statfs := func(dir string) error {
+		available, _, _, _, _, _, err = fs.FsInfo(dir)
+		return err
+	}
+
+	if capacityShare != "" {
+		err = withMountedShare(ctx, cs.mounter, volOptions.Server, capacityShare, cr, statfs)
+	} else {
+		var sm shareManager
+		if sm, err = newShareManager(ctx, volOptions, cr, cs.commander, cs.mounter); err != nil {
+			return 0, err
+		}
+		err = sm.withRootDir(statfs)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
@@ -0,0 +1,203 @@
+package cifs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// configMapCacheLabel marks the ConfigMaps storing controller cache entries,
+	// and configMapSnapshotCacheLabel the ones storing snapshot cache entries.
+	// Their value is configMapCacheEntry, or configMapCacheQuarantined for
+	// entries which couldn't be loaded.
+	configMapCacheLabel         = "csi-cifsplugin/controller-cache"
+	configMapSnapshotCacheLabel = "csi-cifsplugin/snapshot-cache"
+	configMapCacheEntry         = "entry"
+	configMapCacheQuarantined   = "quarantined"
+
+	configMapCacheNamePrefix         = "csi-cifs-cache-"
+	configMapSnapshotCacheNamePrefix = "csi-cifs-snapcache-"
+	configMapCacheDataKey            = "entry.json"
+)
+
+// configMapControllerCacheStore stores each entry in a ConfigMap, so that
+// the controller cache survives rescheduling the controller to another node.
+type configMapControllerCacheStore struct {
+	configMaps corev1.ConfigMapInterface
+
+	// label marks the ConfigMaps of the store, and their names start with namePrefix
+	label      string
+	namePrefix string
+}
+
+var _ controllerCacheStore = &configMapControllerCacheStore{}
+
+func newConfigMapControllerCacheStore(configMaps corev1.ConfigMapInterface) *configMapControllerCacheStore {
+	return &configMapControllerCacheStore{configMaps: configMaps, label: configMapCacheLabel, namePrefix: configMapCacheNamePrefix}
+}
+
+func newConfigMapSnapshotCacheStore(configMaps corev1.ConfigMapInterface) *configMapControllerCacheStore {
+	return &configMapControllerCacheStore{configMaps: configMaps, label: configMapSnapshotCacheLabel, namePrefix: configMapSnapshotCacheNamePrefix}
+}
+
+// configMapName returns the name of the ConfigMap of the entry with the ID id.
+// Volume and snapshot IDs aren't valid object names, so the name is derived from a hash.
+func (s *configMapControllerCacheStore) configMapName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return s.namePrefix + hex.EncodeToString(sum[:16])
+}
+
+func (s *configMapControllerCacheStore) load(f func(data []byte) error) error {
+	cms, err := s.configMaps.List(metav1.ListOptions{LabelSelector: s.label + "=" + configMapCacheEntry})
+	if err != nil {
+		return fmt.Errorf("cannot list %s ConfigMaps: %v", s.label, err)
+	}
+
+	for i := range cms.Items {
+		cm := &cms.Items[i]
+
+		if err = f([]byte(cm.Data[configMapCacheDataKey])); err != nil {
+			glog.Errorf("cifs: failed to load cache entry ConfigMap %s: %v", cm.Name, err)
+			s.quarantine(cm)
+		}
+	}
+
+	return nil
+}
+
+func (s *configMapControllerCacheStore) quarantine(cm *v1.ConfigMap) {
+	cm.Labels[s.label] = configMapCacheQuarantined
+
+	if _, err := s.configMaps.Update(cm); err != nil {
+		glog.Errorf("cifs: failed to quarantine cache entry ConfigMap %s: %v", cm.Name, err)
+		return
+	}
+
+	glog.Warningf("cifs: labeled cache entry ConfigMap %s with %s=%s", cm.Name, s.label, configMapCacheQuarantined)
+}
+
+func (s *configMapControllerCacheStore) save(id string, data []byte) error {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   s.configMapName(id),
+			Labels: map[string]string{s.label: configMapCacheEntry},
+		},
+		Data: map[string]string{configMapCacheDataKey: string(data)},
+	}
+
+	_, err := s.configMaps.Create(cm)
+	if apierrors.IsAlreadyExists(err) {
+		var cur *v1.ConfigMap
+		if cur, err = s.configMaps.Get(cm.Name, metav1.GetOptions{}); err == nil {
+			cm.ResourceVersion = cur.ResourceVersion
+			_, err = s.configMaps.Update(cm)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write cache entry ConfigMap %s: %v", cm.Name, err)
+	}
+
+	return nil
+}
+
+func (s *configMapControllerCacheStore) remove(id string) error {
+	name := s.configMapName(id)
+	if err := s.configMaps.Delete(name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to remove cache entry ConfigMap %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// migrateCacheStore copies the entries of the store from to the store to.
+// decode returns the ID of an entry of a kind, and the data to store.
+func migrateCacheStore(from, to controllerCacheStore, kind string, decode func(data []byte) (string, []byte, error)) (int, error) {
+	n := 0
+
+	err := from.load(func(data []byte) error {
+		id, data, err := decode(data)
+		if err != nil {
+			return err
+		}
+
+		if err = to.save(id, data); err != nil {
+			glog.Errorf("cifs: failed to migrate cache entry for %s %s: %v", kind, id, err)
+			return nil
+		}
+
+		glog.Infof("cifs: migrated cache entry for %s %s", kind, id)
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// migrateControllerCache copies the volume entries of the store from to the store to.
+func migrateControllerCache(from, to controllerCacheStore) (int, error) {
+	return migrateCacheStore(from, to, "volume", func(data []byte) (string, []byte, error) {
+		ent, err := decodeControllerCacheEntry(data)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Entries written before checksums are upgraded on the way
+		data, err = encodeControllerCacheEntry(ent)
+		return string(ent.VolumeID), data, err
+	})
+}
+
+// migrateSnapshotCache copies the snapshot entries of the store from to the store to.
+func migrateSnapshotCache(from, to controllerCacheStore) (int, error) {
+	return migrateCacheStore(from, to, "snapshot", func(data []byte) (string, []byte, error) {
+		ent, err := decodeSnapshotCacheEntry(data)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return string(ent.SnapshotID), data, nil
+	})
+}
+
+// MigrateControllerCache imports the controller and snapshot cache entries
+// stored in the plugin directory of this node into ConfigMaps in namespace,
+// and returns the number of imported entries. The files are left untouched.
+func MigrateControllerCache(namespace string) (int, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return 0, err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+
+	n, err := migrateControllerCache(&fileControllerCacheStore{root: controllerCacheRoot}, newConfigMapControllerCacheStore(configMaps))
+	if err != nil {
+		return n, err
+	}
+
+	m, err := migrateSnapshotCache(&fileControllerCacheStore{root: snapshotCacheRoot}, newConfigMapSnapshotCacheStore(configMaps))
+	return n + m, err
+}
+
+// newInClusterClient returns a Kubernetes client using the service account of the pod.
+func newInClusterClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+	}
+
+	return client, nil
+}
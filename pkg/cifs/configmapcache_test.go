@@ -0,0 +1,209 @@
+package cifs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+var configMapsResource = schema.GroupResource{Resource: "configmaps"}
+
+// fakeConfigMaps stores ConfigMaps in memory. Label selectors must be a single key=value.
+type fakeConfigMaps struct {
+	corev1.ConfigMapInterface
+	cms map[string]*v1.ConfigMap
+}
+
+func newFakeConfigMaps() *fakeConfigMaps {
+	return &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+}
+
+func (c *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if _, ok := c.cms[cm.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(configMapsResource, cm.Name)
+	}
+	c.cms[cm.Name] = cm.DeepCopy()
+	return cm, nil
+}
+
+func (c *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if _, ok := c.cms[cm.Name]; !ok {
+		return nil, apierrors.NewNotFound(configMapsResource, cm.Name)
+	}
+	c.cms[cm.Name] = cm.DeepCopy()
+	return cm, nil
+}
+
+func (c *fakeConfigMaps) Delete(name string, options *metav1.DeleteOptions) error {
+	if _, ok := c.cms[name]; !ok {
+		return apierrors.NewNotFound(configMapsResource, name)
+	}
+	delete(c.cms, name)
+	return nil
+}
+
+func (c *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	cm, ok := c.cms[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(configMapsResource, name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (c *fakeConfigMaps) List(opts metav1.ListOptions) (*v1.ConfigMapList, error) {
+	kv := strings.SplitN(opts.LabelSelector, "=", 2)
+
+	list := &v1.ConfigMapList{}
+	for _, cm := range c.cms {
+		if cm.Labels[kv[0]] == kv[1] {
+			list.Items = append(list.Items, *cm.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func TestConfigMapControllerCacheStore(t *testing.T) {
+	cms := newFakeConfigMaps()
+	s := newConfigMapControllerCacheStore(cms)
+
+	ent := &controllerCacheEntry{VolumeID: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol####", VolumeName: "testvol", CapacityBytes: oneGB}
+
+	// Saving twice updates the ConfigMap
+	for _, sz := range []int64{oneGB, 2 * oneGB} {
+		ent.CapacityBytes = sz
+		data, err := encodeControllerCacheEntry(ent)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err = s.save(string(ent.VolumeID), data); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if len(cms.cms) != 1 {
+		t.Fatalf("expected 1 ConfigMap, but got %d", len(cms.cms))
+	}
+
+	// A corrupted entry is quarantined
+	cms.cms["csi-cifs-cache-corrupted"] = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-cifs-cache-corrupted", Labels: map[string]string{configMapCacheLabel: configMapCacheEntry}},
+		Data:       map[string]string{configMapCacheDataKey: "{"},
+	}
+
+	var loaded []*controllerCacheEntry
+	err := s.load(func(data []byte) error {
+		ent, err := decodeControllerCacheEntry(data)
+		if err == nil {
+			loaded = append(loaded, ent)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(loaded) != 1 || loaded[0].VolumeID != ent.VolumeID || loaded[0].CapacityBytes != 2*oneGB {
+		t.Errorf("expected entry %+v, but got %+v", ent, loaded)
+	}
+	if l := cms.cms["csi-cifs-cache-corrupted"].Labels[configMapCacheLabel]; l != configMapCacheQuarantined {
+		t.Errorf("expected corrupted entry to be quarantined, but got label %q", l)
+	}
+
+	if err = s.remove(string(ent.VolumeID)); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = s.remove(string(ent.VolumeID)); err != nil {
+		t.Errorf("expected removing a removed entry to succeed, but got %v", err)
+	}
+	if _, ok := cms.cms[s.configMapName(string(ent.VolumeID))]; ok {
+		t.Errorf("expected ConfigMap to be removed")
+	}
+}
+
+func TestMigrateControllerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An entry written before checksums, and a corrupted one
+	legacy, _ := json.Marshal(&controllerCacheEntry{VolumeID: "csi-cifs-legacy", VolumeName: "legacy"})
+	for name, data := range map[string][]byte{"legacy.json": legacy, "corrupted.json": []byte("{")} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	cms := newFakeConfigMaps()
+	to := newConfigMapControllerCacheStore(cms)
+	n, err := migrateControllerCache(&fileControllerCacheStore{root: dir}, to)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 migrated entry, but got %d", n)
+	}
+
+	cm, ok := cms.cms[to.configMapName("csi-cifs-legacy")]
+	if !ok {
+		t.Fatalf("expected ConfigMap for volume csi-cifs-legacy")
+	}
+	ent, err := decodeControllerCacheEntry([]byte(cm.Data[configMapCacheDataKey]))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ent.Version != controllerCacheEntryVersion || ent.Checksum == "" {
+		t.Errorf("expected migrated entry to be upgraded, but got version %d and checksum %q", ent.Version, ent.Checksum)
+	}
+}
+
+func TestMigrateSnapshotCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-snapcache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	snap, _ := json.Marshal(&snapshotCacheEntry{SnapshotID: "csi-cifs-snap-testsnap", SnapshotName: "testsnap"})
+	for name, data := range map[string][]byte{"snap.json": snap, "corrupted.json": []byte("{}")} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	cms := newFakeConfigMaps()
+	to := newConfigMapSnapshotCacheStore(cms)
+	n, err := migrateSnapshotCache(&fileControllerCacheStore{root: dir}, to)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 migrated entry, but got %d", n)
+	}
+
+	cm, ok := cms.cms[to.configMapName("csi-cifs-snap-testsnap")]
+	if !ok {
+		t.Fatalf("expected ConfigMap for snapshot csi-cifs-snap-testsnap")
+	}
+	if l := cm.Labels[configMapSnapshotCacheLabel]; l != configMapCacheEntry {
+		t.Errorf("expected label %s=%s, but got %q", configMapSnapshotCacheLabel, configMapCacheEntry, l)
+	}
+
+	// Snapshot entries aren't loaded as volume entries
+	err = newConfigMapControllerCacheStore(cms).load(func(data []byte) error {
+		t.Errorf("unexpected volume entry %s", data)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -1,24 +1,141 @@
 package cifs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
-	"strings"
+	"sort"
 	"sync"
-
-	"github.com/golang/glog"
 )
 
 const (
 	controllerCacheRoot = PluginFolder + "/controller/plugin-cache"
+
+	// controllerCacheEntryVersion is the version of the cache entry format.
+	// Entries without a version predate checksums.
+	controllerCacheEntryVersion = 1
 )
 
 type controllerCacheEntry struct {
-	VolOptions volumeOptions
-	VolumeID   volumeID
+	VolOptions    volumeOptions
+	VolumeID      volumeID
+	VolumeName    string
+	CapacityBytes int64
+
+	// The snapshot or the volume the volume was populated from, if any
+	SourceSnapshotID snapshotID `json:",omitempty"`
+	SourceVolumeID   volumeID   `json:",omitempty"`
+
+	Version  int    `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+}
+
+// checksum returns the checksum of the entry, excluding the Checksum field itself.
+func (ent controllerCacheEntry) checksum() (string, error) {
+	ent.Checksum = ""
+
+	b, err := json.Marshal(&ent)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verify checks that the entry was written in a supported version and wasn't corrupted.
+func (ent *controllerCacheEntry) verify() error {
+	if ent.Version == 0 && ent.Checksum == "" {
+		return nil
+	}
+	if ent.Version != controllerCacheEntryVersion {
+		return fmt.Errorf("unsupported cache entry version %d", ent.Version)
+	}
+
+	sum, err := ent.checksum()
+	if err != nil {
+		return err
+	}
+	if sum != ent.Checksum {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", ent.Checksum, sum)
+	}
+
+	return nil
+}
+
+// encodeControllerCacheEntry sets the version and the checksum of ent and encodes it.
+func encodeControllerCacheEntry(ent *controllerCacheEntry) ([]byte, error) {
+	var err error
+
+	ent.Version = controllerCacheEntryVersion
+	if ent.Checksum, err = ent.checksum(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ent)
+}
+
+// decodeControllerCacheEntry decodes and verifies an encoded cache entry.
+func decodeControllerCacheEntry(data []byte) (*controllerCacheEntry, error) {
+	ent := &controllerCacheEntry{}
+	if err := json.Unmarshal(data, ent); err != nil {
+		return nil, err
+	}
+	if err := ent.verify(); err != nil {
+		return nil, err
+	}
+
+	return ent, nil
+}
+
+// controllerCacheStore persists encoded controller cache entries, of either
+// volumes or snapshots, by their ID.
+type controllerCacheStore interface {
+	// load calls f with each stored entry. Entries for which f fails are
+	// quarantined, so that they are neither lost nor loaded again.
+	load(f func(data []byte) error) error
+	save(id string, data []byte) error
+	remove(id string) error
+}
+
+// fileControllerCacheStore stores each entry in a .json file of the directory root.
+type fileControllerCacheStore struct {
+	root string
+}
+
+var _ controllerCacheStore = &fileControllerCacheStore{}
+
+func (s *fileControllerCacheStore) entryPath(id string) string {
+	return path.Join(s.root, id+".json")
+}
+
+func (s *fileControllerCacheStore) load(f func(data []byte) error) error {
+	if err := loadCacheDir(s.root, f); err != nil {
+		return fmt.Errorf("cannot read cache from %s: %v", s.root, err)
+	}
+
+	return nil
+}
+
+func (s *fileControllerCacheStore) save(id string, data []byte) error {
+	filePath := s.entryPath(id)
+	if err := writeFileAtomic(filePath, data); err != nil {
+		return fmt.Errorf("couldn't write cache entry file '%s': %v", filePath, err)
+	}
+
+	return nil
+}
+
+func (s *fileControllerCacheStore) remove(id string) error {
+	filePath := s.entryPath(id)
+	if err := os.Remove(filePath); err != nil {
+		return fmt.Errorf("failed to remove cache entry file '%s': %v", filePath, err)
+	}
+
+	return nil
 }
 
 type controllerCacheMap map[volumeID]*controllerCacheEntry
@@ -26,69 +143,83 @@ type controllerCacheMap map[volumeID]*controllerCacheEntry
 var (
 	ctrCache    = make(controllerCacheMap)
 	ctrCacheMtx sync.Mutex
+
+	// ctrCacheStore persists the entries of ctrCache
+	ctrCacheStore controllerCacheStore = &fileControllerCacheStore{root: controllerCacheRoot}
 )
 
-// Load all .json files from controllerCacheRoot into ctrCache
-// Called from driver.go's Run()
+// Load all entries from ctrCacheStore into ctrCache, replacing its contents
+// Called from driver.go's Init()
 func loadControllerCache() error {
-	cacheDir, err := ioutil.ReadDir(controllerCacheRoot)
-	if err != nil {
-		return fmt.Errorf("cannot read controller cache from %s: %v", controllerCacheRoot, err)
-	}
-
 	ctrCacheMtx.Lock()
 	defer ctrCacheMtx.Unlock()
 
-	for _, fi := range cacheDir {
-		if !strings.HasSuffix(fi.Name(), ".json") || !fi.Mode().IsRegular() {
-			continue
-		}
+	for volId := range ctrCache {
+		delete(ctrCache, volId)
+	}
 
-		f, err := os.Open(path.Join(controllerCacheRoot, fi.Name()))
+	return ctrCacheStore.load(func(data []byte) error {
+		ent, err := decodeControllerCacheEntry(data)
 		if err != nil {
-			glog.Errorf("cifs: cloudn't read '%s' from controller cache: %v", fi.Name(), err)
-			continue
+			return err
 		}
 
-		d := json.NewDecoder(f)
-		ent := &controllerCacheEntry{}
+		ctrCache[ent.VolumeID] = ent
+		return nil
+	})
+}
 
-		if err = d.Decode(ent); err != nil {
-			glog.Errorf("cifs: failed to parse '%s': %v", fi.Name(), err)
-		} else {
-			ctrCache[ent.VolumeID] = ent
-		}
+func (m controllerCacheMap) insert(ent *controllerCacheEntry) error {
+	ctrCacheMtx.Lock()
+	defer ctrCacheMtx.Unlock()
 
-		f.Close()
+	data, err := encodeControllerCacheEntry(ent)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry for volume %s: %v", ent.VolumeID, err)
 	}
 
+	if err = ctrCacheStore.save(string(ent.VolumeID), data); err != nil {
+		return err
+	}
+
+	m[ent.VolumeID] = ent
+
 	return nil
 }
 
-func getControllerCacheEntryPath(volId volumeID) string {
-	return path.Join(controllerCacheRoot, string(volId)+".json")
-}
+func (m controllerCacheMap) get(volId volumeID) (*controllerCacheEntry, bool) {
+	ctrCacheMtx.Lock()
+	defer ctrCacheMtx.Unlock()
 
-func (m controllerCacheMap) insert(ent *controllerCacheEntry) error {
-	filePath := getControllerCacheEntryPath(ent.VolumeID)
+	ent, ok := m[volId]
+	return ent, ok
+}
 
+func (m controllerCacheMap) getByName(name string) (*controllerCacheEntry, bool) {
 	ctrCacheMtx.Lock()
 	defer ctrCacheMtx.Unlock()
 
-	f, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("couldn't create cache entry file '%s': %v", filePath, err)
+	for _, ent := range m {
+		if ent.VolumeName == name {
+			return ent, true
+		}
 	}
-	defer f.Close()
 
-	enc := json.NewEncoder(f)
-	if err = enc.Encode(ent); err != nil {
-		return fmt.Errorf("failed to encode cache entry for volume %s: %v", ent.VolumeID, err)
-	}
+	return nil, false
+}
 
-	m[ent.VolumeID] = ent
+// list returns the cache entries sorted by volume ID.
+func (m controllerCacheMap) list() []*controllerCacheEntry {
+	ctrCacheMtx.Lock()
+	defer ctrCacheMtx.Unlock()
 
-	return nil
+	ents := make([]*controllerCacheEntry, 0, len(m))
+	for _, ent := range m {
+		ents = append(ents, ent)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].VolumeID < ents[j].VolumeID })
+
+	return ents
 }
 
 func (m controllerCacheMap) pop(volId volumeID) (*controllerCacheEntry, error) {
@@ -100,10 +231,8 @@ func (m controllerCacheMap) pop(volId volumeID) (*controllerCacheEntry, error) {
 		return nil, fmt.Errorf("cache entry for volume %s does not exist", volId)
 	}
 
-	filePath := getControllerCacheEntryPath(volId)
-
-	if err := os.Remove(filePath); err != nil {
-		return nil, fmt.Errorf("failed to remove cache entry file '%s': %v", filePath, err)
+	if err := ctrCacheStore.remove(string(volId)); err != nil {
+		return nil, err
 	}
 
 	delete(m, volId)
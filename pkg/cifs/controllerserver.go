@@ -1,27 +1,45 @@
 package cifs
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"time"
 
 	"github.com/golang/glog"
-	"github.com/pborman/uuid"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 const (
 	oneGB = 1073741824
+
+	// rollbackTimeout limits the cleanup of a failed CreateVolume, which
+	// outlives the request
+	rollbackTimeout = 2 * time.Minute
 )
 
 type controllerServer struct {
-	cr *credentials
 	*csicommon.DefaultControllerServer
 
 	commander Interface
+	mounter   mount.Interface
+
+	locks *operationLocks
+
+	// adminSecretsDir is the directory of the admin credentials used by
+	// RPCs which carry no secrets, if not empty
+	adminSecretsDir string
+	// crossCheckVolumes enables checking the shares of listed volumes
+	crossCheckVolumes bool
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -36,53 +54,243 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	volId := newVolumeID()
-	sharep := string(volId) + "=" + req.GetParameters()["path"]
-	volOptions.Share = string(volId)
+	for _, cap := range req.GetVolumeCapabilities() {
+		if _, err = getMountOptions(req.GetParameters(), cap.GetMount().GetMountFlags()); err != nil {
+			glog.Errorf("validation of mount options failed: %v", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	volOptions.assignShare(newShareName(req.GetName()))
+	volId := newVolumeID(volOptions)
+
+	sz := req.GetCapacityRange().GetRequiredBytes()
+	if sz == 0 {
+		sz = oneGB
+	}
+
+	srcSnapId := snapshotID(req.GetVolumeContentSource().GetSnapshot().GetSnapshotId())
+	srcVolId := volumeID(req.GetVolumeContentSource().GetVolume().GetVolumeId())
+
+	locks := []string{volumeNameLock(req.GetName()), volumeLock(volId), shareLock(volOptions.Server, volOptions.shareName())}
+	if srcSnapId != "" {
+		locks = append(locks, snapshotLock(srcSnapId))
+	}
+	if srcVolId != "" {
+		locks = append(locks, volumeLock(srcVolId))
+	}
 
-	cs.cr, err = getAdminCredentials(req.GetControllerCreateSecrets())
+	release, err := cs.locks.acquire(locks...)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The volume may have been created by a previous call with the same name
+	if ent, ok := ctrCache.getByName(req.GetName()); ok {
+		if !reflect.DeepEqual(ent.VolOptions, *volOptions) || !capacityRangeSatisfied(req.GetCapacityRange(), ent.CapacityBytes) ||
+			ent.SourceSnapshotID != srcSnapId || ent.SourceVolumeID != srcVolId {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters", req.GetName())
+		}
+
+		glog.Infof("cifs: volume %s already exists as %s", req.GetName(), ent.VolumeID)
+		return newCreateVolumeResponse(ent, req.GetParameters()), nil
+	}
+
+	if len(volId) > maxIDLength {
+		return nil, status.Errorf(codes.InvalidArgument, "volume ID %s exceeds %d bytes, shorten the server, share or path parameters", volId, maxIDLength)
+	}
+
+	cr, err := getAdminCredentials(req.GetSecrets())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get admin credentials from create volume secrets: %v", err)
 	}
-	adminpass := fmt.Sprintf("%s%%%s", cs.cr.username, cs.cr.password)
-	// TODO port?
-	debug := "1"
-	if glog.V(4) {
-		debug = "4"
+
+	sm, err := newShareManager(ctx, volOptions, cr, cs.commander, cs.mounter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if cs.commander == nil {
-		// $ net rpc share add SHARE_NAME=/PATH/TO/SHARE COMMENT -S server -d 4
-		args := []string{
-			"rpc", "share", "add", sharep, "\"test comment\"",
-			"-S", volOptions.Server, "-d", debug, "-U", adminpass,
+
+	qm, err := newQuotaManager(ctx, volOptions, sm, cs.commander)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// A previous call may have created the share but failed to store the cache entry
+	created := false
+	if s, err := sm.getShare(volOptions.shareName()); err == nil {
+		if !isShareOfVolume(s, volOptions, req.GetName()) {
+			return nil, status.Errorf(codes.AlreadyExists, "share %s already exists on %s with path %s and comment %q, which don't match volume %s", s.Name, volOptions.Server, s.Path, s.Comment, req.GetName())
 		}
-		cs.commander = &commander{cmd: "net", options: args}
+		glog.Infof("cifs: share for volume %s already exists on %s, reusing it", volId, volOptions.Server)
+	} else if err = sm.createShare(&shareInfo{Name: volOptions.shareName(), Path: volOptions.Path, Comment: req.GetName()}); err != nil {
+		return nil, statusError(codes.Internal, err)
+	} else {
+		created = true
 	}
-	if err := cs.commander.execCommandAndValidate(); err != nil {
-		return nil, err
+
+	// rollback deletes the share if it was created by this call, so that
+	// failed calls don't leave partially populated shares behind. It doesn't
+	// use ctx, which is done when the call failed due to its deadline.
+	rollback := func() {
+		if !created {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+
+		sm, err := newShareManager(ctx, volOptions, cr, cs.commander, cs.mounter)
+		if err != nil {
+			glog.Errorf("failed to delete share of volume %s: %v", volId, err)
+			return
+		}
+		qm, err := newQuotaManager(ctx, volOptions, sm, cs.commander)
+		if err != nil {
+			glog.Errorf("failed to remove quota of volume %s: %v", volId, err)
+			return
+		}
+
+		if err := qm.removeQuota(volOptions.shareName()); err != nil {
+			glog.Errorf("failed to remove quota of volume %s: %v", volId, err)
+		}
+		if err := sm.deleteShare(volOptions.shareName()); err != nil {
+			glog.Errorf("failed to delete share of volume %s: %v", volId, err)
+		}
 	}
-	defer func() { cs.commander = nil }()
 
-	// TODO: Setting quota and attributes
+	if src := req.GetVolumeContentSource(); src != nil {
+		if err = cs.populateShare(ctx, cr, sm, volOptions, src); err != nil {
+			glog.Errorf("failed to populate volume %s: %v", volId, err)
+			rollback()
+			return nil, err
+		}
+	}
 
-	sz := req.GetCapacityRange().GetRequiredBytes()
-	if sz == 0 {
-		sz = oneGB
+	if err = qm.setQuota(volOptions.shareName(), sz); err != nil {
+		glog.Errorf("failed to set quota of volume %s: %v", volId, err)
+		rollback()
+		return nil, statusError(codes.Internal, err)
 	}
 
-	if err = ctrCache.insert(&controllerCacheEntry{VolOptions: *volOptions, VolumeID: volId}); err != nil {
+	ent := &controllerCacheEntry{
+		VolOptions:       *volOptions,
+		VolumeID:         volId,
+		VolumeName:       req.GetName(),
+		CapacityBytes:    sz,
+		SourceSnapshotID: srcSnapId,
+		SourceVolumeID:   srcVolId,
+	}
+	if err = ctrCache.insert(ent); err != nil {
 		glog.Errorf("failed to store a cache entry for volume %s: %v", volId, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		rollback()
+		return nil, statusError(codes.Internal, err)
 	}
 
-	return &csi.CreateVolumeResponse{
+	return newCreateVolumeResponse(ent, req.GetParameters()), nil
+}
+
+func newCreateVolumeResponse(ent *controllerCacheEntry, params map[string]string) *csi.CreateVolumeResponse {
+	res := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			Id:            string(volId),
-			CapacityBytes: sz,
-			Attributes:    req.GetParameters(),
+			VolumeId:      string(ent.VolumeID),
+			CapacityBytes: ent.CapacityBytes,
+			VolumeContext: ent.VolOptions.volumeContext(params),
 		},
-	}, nil
+	}
+
+	switch {
+	case ent.SourceSnapshotID != "":
+		res.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: string(ent.SourceSnapshotID)},
+			},
+		}
+	case ent.SourceVolumeID != "":
+		res.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: string(ent.SourceVolumeID)},
+			},
+		}
+	}
+
+	return res
+}
+
+// populateShare copies the contents of the snapshot or the volume src to the share of the volume described by volOptions.
+func (cs *controllerServer) populateShare(ctx context.Context, cr *credentials, sm shareManager, volOptions *volumeOptions, src *csi.VolumeContentSource) error {
+	var (
+		// srcName names the source in errors
+		srcName    string
+		srcOptions *volumeOptions
+		shadowCopy string
+		err        error
+	)
 
+	switch {
+	case src.GetSnapshot() != nil:
+		snapId := snapshotID(src.GetSnapshot().GetSnapshotId())
+		srcName = "snapshot " + string(snapId)
+		if _, srcOptions, shadowCopy, err = getSnapshotSource(snapId); err != nil {
+			return status.Errorf(codes.NotFound, "snapshot %s not found: %v", snapId, err)
+		}
+	case src.GetVolume() != nil:
+		srcVolId := volumeID(src.GetVolume().GetVolumeId())
+		srcName = "volume " + string(srcVolId)
+		if srcOptions, err = getVolumeOptions(srcVolId); err != nil {
+			if err == errVolumeNotFound {
+				return status.Errorf(codes.NotFound, "source volume %s not found", srcVolId)
+			}
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	default:
+		return status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+
+	srcSm, err := cs.newVolumeShareManager(ctx, srcOptions, cr)
+	if err != nil {
+		if err == errShareNotFound {
+			return status.Errorf(codes.NotFound, "share of source %s not found on %s", srcName, srcOptions.Server)
+		}
+		return err
+	}
+
+	err = srcSm.withShareDir(srcOptions.shareName(), func(srcDir string) error {
+		if shadowCopy != "" {
+			srcDir = shadowCopyPath(srcDir, shadowCopy)
+			if _, err := os.Stat(srcDir); err != nil {
+				if os.IsNotExist(err) {
+					return status.Errorf(codes.NotFound, "shadow copy %s of source %s not found", shadowCopy, srcName)
+				}
+				return err
+			}
+		}
+
+		err := sm.withShareDir(volOptions.shareName(), func(dstDir string) error {
+			return copyShareDir(ctx, cs.commander, srcDir, dstDir, false)
+		})
+		if err == errShareNotFound {
+			return status.Errorf(codes.Internal, "directory of share %s not found", volOptions.shareName())
+		}
+		return err
+	})
+	switch err {
+	case nil:
+		return nil
+	case errShareNotFound:
+		return status.Errorf(codes.NotFound, "share of source %s not found on %s", srcName, srcOptions.Server)
+	}
+
+	return statusError(codes.Internal, err)
+}
+
+// capacityRangeSatisfied reports whether a volume of sz bytes satisfies r.
+func capacityRangeSatisfied(r *csi.CapacityRange, sz int64) bool {
+	if r == nil {
+		return true
+	}
+
+	return sz >= r.GetRequiredBytes() && (r.GetLimitBytes() == 0 || sz <= r.GetLimitBytes())
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -91,77 +299,590 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, err
 	}
 
-	var (
-		volId = volumeID(req.GetVolumeId())
-		err   error
-	)
+	volId := volumeID(req.GetVolumeId())
 
-	// Load volume info from cache
-	ent, err := ctrCache.pop(volId)
+	release, err := cs.locks.acquire(volumeLock(volId))
 	if err != nil {
-		glog.Error(err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
+	defer release()
 
-	defer func() {
-		if err != nil {
-			// Reinsert cache entry for retry
-			if insErr := ctrCache.insert(ent); insErr != nil {
-				glog.Errorf("failed to reinsert volume cache entry in rollback procedure for volume %s: %v", volId, err)
-			}
+	volOptions, err := getVolumeOptions(volId)
+	if err != nil {
+		if err == errVolumeNotFound {
+			glog.Infof("cifs: volume %s not found in cache, assuming it has already been deleted", volId)
+			return &csi.DeleteVolumeResponse{}, nil
 		}
-	}()
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	cs.cr, err = getAdminCredentials(req.GetControllerDeleteSecrets())
+	cr, err := getAdminCredentials(req.GetSecrets())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get admin credentials from create volume secrets: %v", err)
 	}
-	adminpass := fmt.Sprintf("%s%%%s", cs.cr.username, cs.cr.password)
 
-	// TODO port?
+	// Shares are deleted by name, the path is only needed to remove XFS quotas
+	var sm shareManager
+	if volOptions.QuotaManager == xfsQuotaManagerName {
+		sm, err = cs.newVolumeShareManager(ctx, volOptions, cr)
+	} else {
+		sm, err = newShareManager(ctx, volOptions, cr, cs.commander, cs.mounter)
+		if err != nil {
+			err = status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if err != nil {
+		if err != errShareNotFound {
+			return nil, err
+		}
+		glog.Infof("cifs: share of volume %s not found on %s, assuming it has already been deleted", volId, volOptions.Server)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	qm, err := newQuotaManager(ctx, volOptions, sm, cs.commander)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	debug := "1"
-	if glog.V(5) {
-		debug = "4"
+	if err = qm.removeQuota(volOptions.shareName()); err != nil {
+		glog.Errorf("failed to remove quota of volume %s: %v", volId, err)
+		return nil, statusError(codes.Internal, err)
 	}
-	if cs.commander == nil {
-		// $ net rpc share delete $SHARE -S $SERVER -U root%xxx
-		args := []string{
-			"rpc", "share", "delete", ent.VolOptions.Share,
-			"-S", ent.VolOptions.Server, "-d", debug, "-U", adminpass,
+
+	if err = sm.deleteShare(volOptions.shareName()); err != nil {
+		if err != errShareNotFound {
+			return nil, err
 		}
-		cs.commander = &commander{cmd: "net", options: args}
+		glog.Infof("cifs: share of volume %s not found on %s, assuming it has already been deleted", volId, volOptions.Server)
 	}
-	defer func() { cs.commander = nil }()
-	if err := cs.commander.execCommandAndValidate(); err != nil {
-		return nil, err
+
+	if _, ok := ctrCache.get(volId); ok {
+		if _, err = ctrCache.pop(volId); err != nil {
+			glog.Errorf("failed to remove the cache entry for volume %s: %v", volId, err)
+			return nil, statusError(codes.Internal, err)
+		}
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func newVolumeID() volumeID {
-	return volumeID("csi-cifs-" + uuid.NewUUID().String())
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.validateGetCapacityRequest(req); err != nil {
+		glog.Errorf("GetCapacityRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	// No volumes with unsupported capabilities can be provisioned
+	for _, cap := range req.GetVolumeCapabilities() {
+		if m := cap.GetAccessMode(); m != nil && !cs.isSupportedAccessMode(m.GetMode()) {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	// The capacity is only known for a given server
+	if req.GetParameters()["server"] == "" {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	volOptions, err := newVolumeOptions(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// A local path may be a different directory than the one on the server,
+	// so the free space of net shares is only measured on capacityShare
+	capacityShare := req.GetParameters()[capacityShareParam]
+	if volOptions.ShareManager == netShareManagerName && capacityShare == "" {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	bytes, err := cs.getCapacity(ctx, volOptions, capacityShare)
+	if err != nil {
+		glog.Errorf("failed to get the capacity of server %s: %v", volOptions.Server, err)
+		return nil, statusError(codes.Unavailable, err)
+	}
+
+	return &csi.GetCapacityResponse{AvailableCapacity: bytes}, nil
+}
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.validateListVolumesRequest(req); err != nil {
+		glog.Errorf("ListVolumesRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	ents := ctrCache.list()
+
+	start, end, next, err := paginate(len(ents), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	// Volumes whose share was deleted out of band aren't listed
+	missing := make(map[volumeID]bool)
+	if cs.crossCheckVolumes {
+		for _, volId := range cs.findMissingShares(ctx, ents[start:end]) {
+			missing[volId] = true
+		}
+	}
+
+	res := &csi.ListVolumesResponse{NextToken: next}
+	for _, ent := range ents[start:end] {
+		if missing[ent.VolumeID] {
+			continue
+		}
+		res.Entries = append(res.Entries, &csi.ListVolumesResponse_Entry{Volume: newCreateVolumeResponse(ent, nil).Volume})
+	}
+
+	return res, nil
+}
+
+// getAdminSecretsDirCredentials returns the admin credentials stored in adminSecretsDir.
+func (cs *controllerServer) getAdminSecretsDirCredentials() (*credentials, error) {
+	if cs.adminSecretsDir == "" {
+		return nil, errors.New("no admin secrets directory configured")
+	}
+
+	secrets, err := readSecretsDir(cs.adminSecretsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return getAdminCredentials(secrets)
+}
+
+// newVolumeShareManager returns the share manager of the existing volume
+// described by volOptions. The path of net volumes whose ID only holds its
+// hash is resolved from their share, which the add share command of the
+// server exports as the directory named after the share under the path,
+// and errShareNotFound is returned if the share doesn't exist.
+func (cs *controllerServer) newVolumeShareManager(ctx context.Context, volOptions *volumeOptions, cr *credentials) (shareManager, error) {
+	sm, err := newShareManager(ctx, volOptions, cr, cs.commander, cs.mounter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if volOptions.Path != "" || volOptions.PathHash == "" {
+		return sm, nil
+	}
+
+	s, err := sm.getShare(volOptions.shareName())
+	if err != nil {
+		if err == errShareNotFound {
+			return nil, err
+		}
+		return nil, statusError(codes.Internal, err)
+	}
+
+	p := cleanSharePath(s.Path)
+	if path.Base(p) != s.Name || hashPath(path.Dir(p)) != volOptions.PathHash {
+		return nil, status.Errorf(codes.FailedPrecondition, "path %s of share %s isn't under the path of the volume", p, s.Name)
+	}
+	volOptions.Path, volOptions.PathHash = path.Dir(p), ""
+
+	return cs.newVolumeShareManager(ctx, volOptions, cr)
+}
+
+// isShareOfVolume reports whether the existing share s is the one a previous
+// CreateVolume call created for the volume named name with volOptions. net
+// shares are commented with the volume name and are exported as the
+// directory named after the share under the path.
+func isShareOfVolume(s *shareInfo, volOptions *volumeOptions, name string) bool {
+	if volOptions.ShareManager == subdirShareManagerName {
+		// Subdirectories are found under the path by construction
+		return true
+	}
+
+	if s.Comment != name {
+		return false
+	}
+
+	return volOptions.Path == "" || cleanSharePath(s.Path) == path.Join(cleanSharePath(volOptions.Path), s.Name)
+}
+
+// shareListKey identifies the shares listed by a share manager.
+type shareListKey struct {
+	shareManager string
+	server       string
+	share        string
+	path         string
+}
+
+func newShareListKey(o *volumeOptions) shareListKey {
+	key := shareListKey{shareManager: o.ShareManager, server: o.Server}
+	if o.ShareManager == subdirShareManagerName {
+		key.share, key.path = o.Share, o.Path
+	}
+
+	return key
+}
+
+// findMissingShares lists the shares on the servers of the volumes ents
+// with the admin credentials stored in adminSecretsDir and returns
+// the volumes whose share doesn't exist anymore.
+func (cs *controllerServer) findMissingShares(ctx context.Context, ents []*controllerCacheEntry) []volumeID {
+	cr, err := cs.getAdminSecretsDirCredentials()
+	if err != nil {
+		glog.Errorf("cifs: failed to cross-check volumes: %v", err)
+		return nil
+	}
+
+	shares := make(map[shareListKey]map[string]bool)
+	var missing []volumeID
+
+	for _, ent := range ents {
+		o := ent.VolOptions
+		key := newShareListKey(&o)
+
+		names, ok := shares[key]
+		if !ok {
+			sm, err := newShareManager(ctx, &o, cr, cs.commander, cs.mounter)
+			if err != nil {
+				glog.Errorf("cifs: failed to cross-check volume %s: %v", ent.VolumeID, err)
+				continue
+			}
+
+			list, err := sm.listShares()
+			if err != nil {
+				glog.Errorf("cifs: failed to list shares on %s: %v", o.Server, err)
+			}
+
+			// Volumes aren't reported as missing if the shares couldn't be listed
+			names = make(map[string]bool)
+			for _, name := range list {
+				names[name] = true
+			}
+			if err != nil {
+				names = nil
+			}
+			shares[key] = names
+		}
+
+		if names != nil && !names[o.shareName()] {
+			glog.Warningf("cifs: share %s of volume %s not found on %s", o.shareName(), ent.VolumeID, o.Server)
+			missing = append(missing, ent.VolumeID)
+		}
+	}
+
+	return missing
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	r := &csi.ValidateVolumeCapabilitiesResponse{
-		Supported: true,
+	if err := validateValidateVolumeCapabilitiesRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := getVolumeOptions(volumeID(req.GetVolumeId())); err != nil {
+		if err == errVolumeNotFound {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	// CIFS doesn't support Block volume
-	for _, cap := range req.VolumeCapabilities {
+
+	for _, cap := range req.GetVolumeCapabilities() {
+		// CIFS doesn't support Block volume
 		if t := cap.GetBlock(); t != nil {
-			r.Supported = false
-			break
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "block volumes are not supported"}, nil
+		}
+		if m := cap.GetAccessMode(); m != nil && !cs.isSupportedAccessMode(m.GetMode()) {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("access mode %s is not supported, supported access modes are %v", m.GetMode(), cs.supportedAccessModes()),
+			}, nil
 		}
 		if t := cap.GetMount(); t != nil {
 			// If a filesystem is given, it must be cifs
 			fs := t.GetFsType()
 			if fs != "" && fs != "cifs" {
-				r.Supported = false
-				break
+				return &csi.ValidateVolumeCapabilitiesResponse{Message: fmt.Sprintf("filesystem %s is not supported", fs)}, nil
 			}
 		}
 	}
-	return r, nil
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.validateControllerExpandVolumeRequest(req); err != nil {
+		glog.Errorf("ControllerExpandVolumeRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	volId := volumeID(req.GetVolumeId())
+
+	release, err := cs.locks.acquire(volumeLock(volId))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	volOptions, err := getVolumeOptions(volId)
+	if err != nil {
+		if err == errVolumeNotFound {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volId)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sz := req.GetCapacityRange().GetRequiredBytes()
+	if sz == 0 {
+		sz = req.GetCapacityRange().GetLimitBytes()
+	}
+
+	// Shares can't be shrunk, the volume may already be larger than requested
+	ent, cached := ctrCache.get(volId)
+	if cached && ent.CapacityBytes >= sz {
+		glog.Infof("cifs: volume %s already has %d bytes", volId, ent.CapacityBytes)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: ent.CapacityBytes, NodeExpansionRequired: false}, nil
+	}
+
+	cr, err := getAdminCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin credentials from controller expand secrets: %v", err)
+	}
+
+	sm, err := cs.newVolumeShareManager(ctx, volOptions, cr)
+	if err != nil {
+		if err == errShareNotFound {
+			return nil, status.Errorf(codes.NotFound, "share of volume %s not found on %s", volId, volOptions.Server)
+		}
+		return nil, err
+	}
+
+	qm, err := newQuotaManager(ctx, volOptions, sm, cs.commander)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err = qm.setQuota(volOptions.shareName(), sz); err != nil {
+		glog.Errorf("failed to set quota of volume %s: %v", volId, err)
+		return nil, statusError(codes.Internal, err)
+	}
+
+	if cached {
+		expanded := *ent
+		expanded.CapacityBytes = sz
+		if err = ctrCache.insert(&expanded); err != nil {
+			glog.Errorf("failed to store the cache entry for volume %s: %v", volId, err)
+			return nil, statusError(codes.Internal, err)
+		}
+	}
+
+	glog.Infof("cifs: successfully expanded volume %s to %d bytes", volId, sz)
+
+	// SMB clients see the new size of the share immediately
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: sz, NodeExpansionRequired: false}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.validateCreateSnapshotRequest(req); err != nil {
+		glog.Errorf("CreateSnapshotRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	volId := volumeID(req.GetSourceVolumeId())
+
+	release, err := cs.locks.acquire(snapshotNameLock(req.GetName()), volumeLock(volId))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	snapshotterName := defaultSnapshotter
+	extractOptionalOption(&snapshotterName, "snapshotter", req.GetParameters())
+
+	snapr, err := newSnapshotter(ctx, snapshotterName, cs.commander)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The snapshot may have been taken by a previous call with the same name
+	if ent, ok := snapCache.getByName(req.GetName()); ok {
+		if ent.SourceVolumeID != volId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", req.GetName(), ent.SourceVolumeID)
+		}
+
+		glog.Infof("cifs: snapshot %s already exists as %s", req.GetName(), ent.SnapshotID)
+		return &csi.CreateSnapshotResponse{Snapshot: newCSISnapshot(ent)}, nil
+	}
+
+	volOptions, err := getVolumeOptions(volId)
+	if err != nil {
+		if err == errVolumeNotFound {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volId)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	cr, err := getAdminCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin credentials from create snapshot secrets: %v", err)
+	}
+
+	sm, err := cs.newVolumeShareManager(ctx, volOptions, cr)
+	if err != nil {
+		if err == errShareNotFound {
+			return nil, status.Errorf(codes.NotFound, "share of volume %s not found on %s", volId, volOptions.Server)
+		}
+		return nil, err
+	}
+
+	t := time.Now()
+	shadowCopy := shadowCopyName(t)
+
+	snapId := newSnapshotID(snapshotterName, volOptions, t)
+	if len(snapId) > maxIDLength {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot ID %s of volume %s exceeds %d bytes", snapId, volId, maxIDLength)
+	}
+
+	err = sm.withShareDir(volOptions.shareName(), func(dir string) error {
+		return snapr.createSnapshot(dir, shadowCopyPath(dir, shadowCopy))
+	})
+	switch err {
+	case nil:
+	case errShareNotFound:
+		return nil, status.Errorf(codes.NotFound, "share of volume %s not found on %s", volId, volOptions.Server)
+	case errSnapshotExists:
+		return nil, status.Errorf(codes.Aborted, "a snapshot of volume %s has already been taken at %s, retry later", volId, shadowCopy)
+	default:
+		glog.Errorf("failed to take snapshot of volume %s: %v", volId, err)
+		return nil, statusError(codes.Internal, err)
+	}
+
+	ent := &snapshotCacheEntry{
+		SnapshotID:     snapId,
+		SnapshotName:   req.GetName(),
+		SourceVolumeID: volId,
+		CreationTime:   t.Unix(),
+	}
+	if volEnt, ok := ctrCache.get(volId); ok {
+		ent.SizeBytes = volEnt.CapacityBytes
+	}
+
+	if err = snapCache.insert(ent); err != nil {
+		glog.Errorf("failed to store a cache entry for snapshot %s: %v", ent.SnapshotID, err)
+		return nil, statusError(codes.Internal, err)
+	}
+
+	glog.Infof("cifs: successfully took snapshot %s of volume %s", ent.SnapshotID, volId)
+
+	return &csi.CreateSnapshotResponse{Snapshot: newCSISnapshot(ent)}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := cs.validateDeleteSnapshotRequest(req); err != nil {
+		glog.Errorf("DeleteSnapshotRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	snapId := snapshotID(req.GetSnapshotId())
+
+	release, err := cs.locks.acquire(snapshotLock(snapId))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	snapshotterName, volOptions, shadowCopy, err := getSnapshotSource(snapId)
+	if err != nil {
+		glog.Infof("cifs: %v, assuming snapshot %s doesn't exist", err, snapId)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	cr, err := getAdminCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin credentials from delete snapshot secrets: %v", err)
+	}
+
+	snapr, err := newSnapshotter(ctx, snapshotterName, cs.commander)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sm, err := cs.newVolumeShareManager(ctx, volOptions, cr)
+	if err == nil {
+		err = sm.withShareDir(volOptions.shareName(), func(dir string) error {
+			return snapr.deleteSnapshot(shadowCopyPath(dir, shadowCopy))
+		})
+	}
+	if err != nil {
+		if err != errShareNotFound {
+			glog.Errorf("failed to delete snapshot %s: %v", snapId, err)
+			return nil, statusError(codes.Internal, err)
+		}
+		glog.Infof("cifs: share %s of snapshot %s not found on %s, assuming the snapshot has been deleted with the volume", volOptions.shareName(), snapId, volOptions.Server)
+	}
+
+	if _, ok := snapCache.get(snapId); ok {
+		if _, err = snapCache.pop(snapId); err != nil {
+			glog.Errorf("failed to remove the cache entry for snapshot %s: %v", snapId, err)
+			return nil, statusError(codes.Internal, err)
+		}
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.validateListSnapshotsRequest(req); err != nil {
+		glog.Errorf("ListSnapshotsRequest validation failed: %v", err)
+		return nil, err
+	}
+
+	var ents []*snapshotCacheEntry
+	for _, ent := range snapCache.list() {
+		if req.GetSnapshotId() != "" && string(ent.SnapshotID) != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && string(ent.SourceVolumeID) != req.GetSourceVolumeId() {
+			continue
+		}
+		ents = append(ents, ent)
+	}
+
+	start, end, next, err := paginate(len(ents), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	res := &csi.ListSnapshotsResponse{NextToken: next}
+	for _, ent := range ents[start:end] {
+		res.Entries = append(res.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newCSISnapshot(ent)})
+	}
+
+	return res, nil
+}
+
+func newCSISnapshot(ent *snapshotCacheEntry) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     string(ent.SnapshotID),
+		SourceVolumeId: string(ent.SourceVolumeID),
+		SizeBytes:      ent.SizeBytes,
+		CreationTime:   &timestamp.Timestamp{Seconds: ent.CreationTime},
+		ReadyToUse:     true,
+	}
+}
+
+func (cs *controllerServer) isSupportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+		if m.GetMode() == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// supportedAccessModes returns the names of the access modes supported by the driver.
+func (cs *controllerServer) supportedAccessModes() []string {
+	var modes []string
+	for _, m := range cs.Driver.GetVolumeCapabilityAccessModes() {
+		modes = append(modes, m.GetMode().String())
+	}
+
+	return modes
 }
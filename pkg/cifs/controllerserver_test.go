@@ -2,12 +2,38 @@ package cifs
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
 	"github.com/kubernetes-csi/csi-test/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
+// newShareCommander reports the share looked up by the first command as not
+// found, as for a new volume, and returns out for the other commands.
+type newShareCommander struct {
+	fakeCommander
+	out    []byte
+	looked bool
+}
+
+func (c *newShareCommander) execCommand(ctx context.Context) ([]byte, error) {
+	if !c.looked {
+		c.looked = true
+		return []byte("WERR_NERR_NETNAMENOTFOUND"), errors.New("exit status 255")
+	}
+
+	return c.out, nil
+}
+
 func TestCreateVolume(t *testing.T) {
 	// Setup simple driver
 	d := NewCifsDriver()
@@ -33,18 +59,90 @@ func TestCreateVolume(t *testing.T) {
 		{
 			name: "Success",
 			req: &csi.CreateVolumeRequest{
-				ControllerCreateSecrets: map[string]string{"admin_name": "user", "admin_password": "pass"},
-				Parameters:              map[string]string{"server": "192.168.122.1"},
-				Name:                    "testvol",
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1"},
+				Name:       "testvol",
 			},
 			errors: false,
 			expId:  "foo",
 		},
+		{
+			name: "Fail due to missing share in subdir mode",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "subdir"},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to unknown share manager",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "foo"},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Success with dfree quota",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "quotaManager": "dfree"},
+				Name:       "testvol-quota",
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to xfs quota in subdir mode",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "subdir", "share": "vols", "quotaManager": "xfs"},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to path outside of share in subdir mode",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "subdir", "share": "vols", "path": "k8s/../.."},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to absolute path in subdir mode",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "subdir", "share": "vols", "path": "/k8s"},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to unknown quota manager",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": "192.168.122.1", "quotaManager": "foo"},
+				Name:       "testvol",
+			},
+			errors: true,
+		},
 		{
 			name: "Fail due to missing password",
 			req: &csi.CreateVolumeRequest{
-				ControllerCreateSecrets: map[string]string{"admin_name": "user"},
-				Name: "testvol",
+				Secrets: map[string]string{"admin_name": "user"},
+				Name:    "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to volume ID over 128 bytes",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+				Parameters: map[string]string{"server": strings.Repeat("fileserver", 8) + ".example.com"},
+				Name:       "testvol-long",
 			},
 			errors: true,
 		},
@@ -53,6 +151,7 @@ func TestCreateVolume(t *testing.T) {
 	// Make a call
 	c := csi.NewControllerClient(conn)
 	for _, tc := range tests {
+		d.cs.commander = &newShareCommander{}
 		res, err := c.CreateVolume(context.Background(), tc.req)
 		if err != nil && !tc.errors {
 			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
@@ -60,12 +159,153 @@ func TestCreateVolume(t *testing.T) {
 		if err == nil && tc.errors {
 			t.Errorf("%s: expected error, but not got any error", tc.name)
 		}
-		if err == nil && res.Volume.Id == "" {
+		if err == nil && res.Volume.VolumeId == "" {
 			t.Errorf("%s: expected volume ID", tc.name)
 		}
 	}
 }
 
+func TestCreateVolumeIdempotency(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	const name = "testvol-idempotency"
+	secrets := map[string]string{"admin_name": "user", "admin_password": "pass"}
+
+	c := csi.NewControllerClient(conn)
+	d.cs.commander = &newShareCommander{}
+	res, err := c.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Secrets:    secrets,
+		Parameters: map[string]string{"server": "192.168.122.1"},
+		Name:       name,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err.Error())
+	}
+	defer ctrCache.pop(volumeID(res.Volume.VolumeId))
+
+	tests := []struct {
+		name    string
+		req     *csi.CreateVolumeRequest
+		expCode codes.Code
+	}{
+		{
+			name: "Success with same parameters",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: map[string]string{"server": "192.168.122.1"},
+				Name:       name,
+			},
+			expCode: codes.OK,
+		},
+		{
+			name: "Fail due to different server",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: map[string]string{"server": "192.168.122.2"},
+				Name:       name,
+			},
+			expCode: codes.AlreadyExists,
+		},
+		{
+			name: "Fail due to larger capacity",
+			req: &csi.CreateVolumeRequest{
+				Secrets:       secrets,
+				Parameters:    map[string]string{"server": "192.168.122.1"},
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * oneGB},
+				Name:          name,
+			},
+			expCode: codes.AlreadyExists,
+		},
+	}
+
+	for _, tc := range tests {
+		r, err := c.CreateVolume(context.Background(), tc.req)
+		if code := status.Code(err); code != tc.expCode {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.expCode, code)
+		}
+		if err == nil && r.Volume.VolumeId != res.Volume.VolumeId {
+			t.Errorf("%s: expected volume ID %s, but got %s", tc.name, res.Volume.VolumeId, r.Volume.VolumeId)
+		}
+	}
+}
+
+func TestCreateVolumeExistingShare(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	const name = "testvol-existing"
+	share := newShareName(name)
+	req := &csi.CreateVolumeRequest{
+		Secrets:    map[string]string{"admin_name": "user", "admin_password": "pass"},
+		Parameters: map[string]string{"server": "192.168.122.1", "path": "/srv/shares"},
+		Name:       name,
+	}
+
+	tests := []struct {
+		name    string
+		info    string
+		expCode codes.Code
+	}{
+		{
+			name:    "Fail due to share of a different volume",
+			info:    "remark: testvol-other\npath: C:\\srv\\shares\\" + share + "\n",
+			expCode: codes.AlreadyExists,
+		},
+		{
+			name:    "Fail due to share outside of path",
+			info:    "remark: " + name + "\npath: C:\\srv\\other\\" + share + "\n",
+			expCode: codes.AlreadyExists,
+		},
+		{
+			name:    "Fail due to share without comment",
+			info:    "path: C:\\srv\\shares\\" + share + "\n",
+			expCode: codes.AlreadyExists,
+		},
+		{
+			name:    "Success with share of a previous call",
+			info:    "remark: " + name + "\npath: C:\\srv\\shares\\" + share + "\n",
+			expCode: codes.OK,
+		},
+	}
+
+	c := csi.NewControllerClient(conn)
+	for _, tc := range tests {
+		d.cs.commander = &listCommander{out: []byte(tc.info)}
+		res, err := c.CreateVolume(context.Background(), req)
+		if code := status.Code(err); code != tc.expCode {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.expCode, err)
+		}
+		if err == nil {
+			ctrCache.pop(volumeID(res.GetVolume().GetVolumeId()))
+		}
+	}
+}
+
 const testVID = "csi-cifs-testvol"
 
 func TestDeleteVolume(t *testing.T) {
@@ -99,8 +339,25 @@ func TestDeleteVolume(t *testing.T) {
 		{
 			name: "Success",
 			req: &csi.DeleteVolumeRequest{
-				VolumeId:                testVID,
-				ControllerDeleteSecrets: map[string]string{"admin_name": "user", "admin_password": "pass"},
+				VolumeId: testVID,
+				Secrets:  map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: false,
+		},
+		{
+			name: "Success with already deleted volume",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVID,
+				Secrets:  map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: false,
+		},
+		{
+			// The path, which isn't in the volume ID, is only resolved for XFS quotas
+			name: "Success with uncached volume",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: string(newVolumeID(&volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testuncached", Path: "/srv/samba"})),
+				Secrets:  map[string]string{"admin_name": "user", "admin_password": "pass"},
 			},
 			errors: false,
 		},
@@ -117,6 +374,100 @@ func TestDeleteVolume(t *testing.T) {
 			t.Errorf("%s: expected error, but not got any error", tc.name)
 		}
 	}
+
+	// Operations on a volume with an operation in flight are aborted
+	release, err := d.cs.locks.acquire(volumeLock(volumeID(testVID)))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer release()
+
+	if _, err = c.DeleteVolume(context.Background(), tests[0].req); status.Code(err) != codes.Aborted {
+		t.Errorf("expected code %v for volume with an operation in flight, but got %v", codes.Aborted, err)
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	volOptions := &volumeOptions{Server: "192.168.122.1", Share: testVID}
+	if err = ctrCache.insert(&controllerCacheEntry{VolOptions: *volOptions, VolumeID: volumeID(testVID), CapacityBytes: oneGB}); err != nil {
+		t.Errorf("failed to store a cache entry for volume %s: %v", testVID, err)
+	}
+	defer ctrCache.pop(volumeID(testVID))
+
+	tests := []struct {
+		name   string
+		req    *csi.ControllerExpandVolumeRequest
+		errors bool
+		expSz  int64
+	}{
+		{
+			name: "Success",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * oneGB},
+				Secrets:       map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: false,
+			expSz:  2 * oneGB,
+		},
+		{
+			name: "Success with smaller capacity",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: oneGB},
+				Secrets:       map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: false,
+			expSz:  2 * oneGB,
+		},
+		{
+			name: "Fail due to missing capacity range",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: testVID,
+				Secrets:  map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to unknown volume",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "testvol",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * oneGB},
+				Secrets:       map[string]string{"admin_name": "user", "admin_password": "pass"},
+			},
+			errors: true,
+		},
+	}
+
+	// Make a call
+	c := csi.NewControllerClient(conn)
+	for _, tc := range tests {
+		res, err := c.ControllerExpandVolume(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && (res.CapacityBytes != tc.expSz || res.NodeExpansionRequired) {
+			t.Errorf("%s: expected %d bytes without node expansion, but got %d bytes, node expansion %v", tc.name, tc.expSz, res.CapacityBytes, res.NodeExpansionRequired)
+		}
+	}
 }
 
 func TestValidateVolumeCapabilities(t *testing.T) {
@@ -134,6 +485,12 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 	}
 	defer conn.Close()
 
+	volOptions := &volumeOptions{Server: "192.168.122.1", Share: testVID}
+	if err = ctrCache.insert(&controllerCacheEntry{VolOptions: *volOptions, VolumeID: volumeID(testVID)}); err != nil {
+		t.Errorf("failed to store a cache entry for volume %s: %v", testVID, err)
+	}
+	defer ctrCache.pop(volumeID(testVID))
+
 	tests := []struct {
 		name       string
 		req        *csi.ValidateVolumeCapabilitiesRequest
@@ -141,18 +498,31 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		expSupport bool
 	}{
 		{
-			name: "Success",
+			name: "Fail due to missing capabilities",
 			req: &csi.ValidateVolumeCapabilitiesRequest{
-				VolumeId:           "testvol",
+				VolumeId:           testVID,
 				VolumeCapabilities: []*csi.VolumeCapability{},
 			},
-			errors:     false,
-			expSupport: true,
+			errors: true,
 		},
 		{
-			name: "Not supported as Block",
+			name: "Fail due to unknown volume",
 			req: &csi.ValidateVolumeCapabilitiesRequest{
 				VolumeId: "testvol",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+					},
+				},
+			},
+			errors: true,
+		},
+		{
+			name: "Not supported as Block",
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: testVID,
 				VolumeCapabilities: []*csi.VolumeCapability{
 					{
 						AccessType: &csi.VolumeCapability_Block{
@@ -167,7 +537,7 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		{
 			name: "Supported as MOUNT",
 			req: &csi.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "testvol",
+				VolumeId: testVID,
 				VolumeCapabilities: []*csi.VolumeCapability{
 					{
 						AccessType: &csi.VolumeCapability_Mount{
@@ -182,7 +552,7 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		{
 			name: "Support as cifs",
 			req: &csi.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "testvol",
+				VolumeId: testVID,
 				VolumeCapabilities: []*csi.VolumeCapability{
 					{
 						AccessType: &csi.VolumeCapability_Mount{
@@ -194,10 +564,46 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 			errors:     false,
 			expSupport: true,
 		},
+		{
+			name: "Supported as readonly",
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: testVID,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+						},
+					},
+				},
+			},
+			errors:     false,
+			expSupport: true,
+		},
+		{
+			name: "Not supported as unknown access mode",
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: testVID,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_UNKNOWN,
+						},
+					},
+				},
+			},
+			errors:     false,
+			expSupport: false,
+		},
 		{
 			name: "Not support as non-cifs",
 			req: &csi.ValidateVolumeCapabilitiesRequest{
-				VolumeId: "testvol",
+				VolumeId: testVID,
 				VolumeCapabilities: []*csi.VolumeCapability{
 					{
 						AccessType: &csi.VolumeCapability_Mount{
@@ -221,8 +627,507 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		if err == nil && tc.errors {
 			t.Errorf("%s: expected error, but not got any error", tc.name)
 		}
-		if res.Supported != tc.expSupport {
-			t.Errorf("%s: expected supported as %v, but got %v", tc.name, tc.expSupport, res.Supported)
+		if err == nil && (res.Confirmed != nil) != tc.expSupport {
+			t.Errorf("%s: expected supported as %v, but got %v", tc.name, tc.expSupport, res.Confirmed != nil)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "csi-cifs-shares-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The path of volumes missing from the controller cache is resolved from their share
+	d.cs.commander = &listCommander{out: []byte("path: " + filepath.Join(dir, "csi-cifs-testsnap") + "\n")}
+
+	volOptions := &volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testsnap", Path: dir}
+	if err = os.Mkdir(filepath.Join(dir, volOptions.Share), 0755); err != nil {
+		t.Fatalf("failed to create share directory: %v", err)
+	}
+	volId := string(newVolumeID(volOptions))
+	secrets := map[string]string{"admin_name": "user", "admin_password": "pass"}
+
+	c := csi.NewControllerClient(conn)
+
+	res, err := c.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: volId, Name: "testsnap", Secrets: secrets})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	snapId := res.GetSnapshot().GetSnapshotId()
+
+	tests := []struct {
+		name   string
+		req    *csi.CreateSnapshotRequest
+		errors bool
+	}{
+		{
+			name:   "Success with same name",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: volId, Name: "testsnap", Secrets: secrets},
+			errors: false,
+		},
+		{
+			name:   "Fail due to same name with different volume",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: testVID, Name: "testsnap", Secrets: secrets},
+			errors: true,
+		},
+		{
+			name:   "Fail due to unknown volume",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: "testvol", Name: "testsnap-unknown", Secrets: secrets},
+			errors: true,
+		},
+		{
+			name:   "Fail due to unknown snapshotter",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: volId, Name: "testsnap-foo", Secrets: secrets, Parameters: map[string]string{"snapshotter": "foo"}},
+			errors: true,
+		},
+		{
+			name:   "Fail due to missing name",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: volId, Secrets: secrets},
+			errors: true,
+		},
+	}
+
+	for _, tc := range tests {
+		res, err := c.CreateSnapshot(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && res.GetSnapshot().GetSnapshotId() != snapId {
+			t.Errorf("%s: expected snapshot %s, but got %s", tc.name, snapId, res.GetSnapshot().GetSnapshotId())
+		}
+	}
+
+	_, _, shadowCopy, err := decodeSnapshotID(snapshotID(snapId))
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, volOptions.Share, ".snapshots", shadowCopy)); err != nil {
+		t.Errorf("expected shadow copy %s, but got %v", shadowCopy, err)
+	}
+
+	list, err := c.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: volId})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(list.GetEntries()) != 1 || list.GetEntries()[0].GetSnapshot().GetSnapshotId() != snapId {
+		t.Errorf("expected snapshot %s, but got %v", snapId, list.GetEntries())
+	}
+
+	if _, err = c.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "foo"}); err == nil {
+		t.Errorf("expected error for invalid starting token, but not got any error")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = c.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapId, Secrets: secrets}); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, volOptions.Share, ".snapshots", shadowCopy)); !os.IsNotExist(err) {
+		t.Errorf("expected shadow copy %s to be deleted, but got %v", shadowCopy, err)
+	}
+
+	list, err = c.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapId})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(list.GetEntries()) != 0 {
+		t.Errorf("expected no snapshots, but got %v", list.GetEntries())
+	}
+}
+
+func TestCreateVolumeFromContentSource(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "csi-cifs-shares-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The path of volumes missing from the controller cache is resolved from their share
+	srcInfo := []byte("path: " + filepath.Join(dir, "csi-cifs-testsrc") + "\n")
+	d.cs.commander = &listCommander{out: srcInfo}
+
+	// The shares are created by the add share command of the server
+	for _, name := range []string{"csi-cifs-testsrc", newShareName("testclone"), newShareName("testrestore")} {
+		if err = os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("failed to create share directory: %v", err)
+		}
+	}
+
+	srcVolId := string(newVolumeID(&volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testsrc", Path: dir}))
+	secrets := map[string]string{"admin_name": "user", "admin_password": "pass"}
+	params := map[string]string{"server": "192.168.122.1", "path": dir}
+
+	c := csi.NewControllerClient(conn)
+
+	snap, err := c.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: srcVolId, Name: "testsrc-snap", Secrets: secrets})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer c.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshot().GetSnapshotId(), Secrets: secrets})
+
+	tests := []struct {
+		name    string
+		req     *csi.CreateVolumeRequest
+		errors  bool
+		expCode codes.Code
+	}{
+		{
+			name: "Success with volume",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: params,
+				Name:       "testclone",
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcVolId},
+					},
+				},
+			},
+			errors: false,
+		},
+		{
+			name: "Success with snapshot",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: params,
+				Name:       "testrestore",
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshot().GetSnapshotId()},
+					},
+				},
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to unknown volume",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: params,
+				Name:       "testclone-unknown",
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "testvol"},
+					},
+				},
+			},
+			errors:  true,
+			expCode: codes.NotFound,
+		},
+		{
+			name: "Fail due to unknown snapshot",
+			req: &csi.CreateVolumeRequest{
+				Secrets:    secrets,
+				Parameters: params,
+				Name:       "testrestore-unknown",
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "testsnap"},
+					},
+				},
+			},
+			errors:  true,
+			expCode: codes.NotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		d.cs.commander = &newShareCommander{out: srcInfo}
+		res, err := c.CreateVolume(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err != nil && tc.errors && status.Code(err) != tc.expCode {
+			t.Errorf("%s: expected %v, but got %v", tc.name, tc.expCode, status.Code(err))
+		}
+		if err == nil {
+			if !proto.Equal(res.GetVolume().GetContentSource(), tc.req.GetVolumeContentSource()) {
+				t.Errorf("%s: expected content source %v, but got %v", tc.name, tc.req.GetVolumeContentSource(), res.GetVolume().GetContentSource())
+			}
+			ctrCache.pop(volumeID(res.GetVolume().GetVolumeId()))
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	c := csi.NewControllerClient(conn)
+	secrets := map[string]string{"admin_name": "user", "admin_password": "pass"}
+
+	expIds := make(map[string]bool)
+	for _, name := range []string{"testlist-a", "testlist-b", "testlist-c"} {
+		d.cs.commander = &newShareCommander{}
+		res, err := c.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Secrets:    secrets,
+			Parameters: map[string]string{"server": "192.168.122.1"},
+			Name:       name,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expIds[res.GetVolume().GetVolumeId()] = true
+	}
+
+	// Page through all the volumes, one at a time
+	var token string
+	for pages := 0; ; pages++ {
+		if pages > len(ctrCache) {
+			t.Fatalf("expected at most %d pages", len(ctrCache))
+		}
+
+		res, err := c.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: token})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(res.GetEntries()) > 1 {
+			t.Errorf("expected at most 1 entry, but got %d", len(res.GetEntries()))
+		}
+		for _, ent := range res.GetEntries() {
+			delete(expIds, ent.GetVolume().GetVolumeId())
+		}
+
+		if token = res.GetNextToken(); token == "" {
+			break
+		}
+	}
+	if len(expIds) != 0 {
+		t.Errorf("expected volumes %v to be listed", expIds)
+	}
+
+	tests := []struct {
+		name string
+		req  *csi.ListVolumesRequest
+		code codes.Code
+	}{
+		{name: "Fail due to invalid starting token", req: &csi.ListVolumesRequest{StartingToken: "foo"}, code: codes.Aborted},
+		{name: "Fail due to out of range starting token", req: &csi.ListVolumesRequest{StartingToken: "1000000"}, code: codes.Aborted},
+		{name: "Fail due to negative max entries", req: &csi.ListVolumesRequest{MaxEntries: -1}, code: codes.InvalidArgument},
+	}
+
+	for _, tc := range tests {
+		_, err := c.ListVolumes(context.Background(), tc.req)
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+func TestFindMissingShares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-secrets-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{"admin_name": "user", "admin_password": "pass"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+
+	cs := &controllerServer{commander: &fakeCommander{}, adminSecretsDir: dir, crossCheckVolumes: true}
+
+	volOptions := volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testmissing"}
+	volId := newVolumeID(&volOptions)
+
+	// fakeCommander lists no shares
+	missing := cs.findMissingShares(context.Background(), []*controllerCacheEntry{{VolumeID: volId, VolOptions: volOptions}})
+	if len(missing) != 1 || missing[0] != volId {
+		t.Errorf("expected missing volume %s, but got %v", volId, missing)
+	}
+
+	// Volumes whose share is missing aren't listed
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = cs.commander
+	d.cs.adminSecretsDir = cs.adminSecretsDir
+	d.cs.crossCheckVolumes = true
+
+	if err = ctrCache.insert(&controllerCacheEntry{VolumeID: volId, VolOptions: volOptions, VolumeName: "testmissing"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer ctrCache.pop(volId)
+
+	res, err := d.cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, ent := range res.GetEntries() {
+		if ent.GetVolume().GetVolumeId() == string(volId) {
+			t.Errorf("expected volume %s not to be listed", volId)
+		}
+	}
+
+	cs.adminSecretsDir = filepath.Join(dir, "nonexistent")
+	if missing = cs.findMissingShares(context.Background(), []*controllerCacheEntry{{VolumeID: volId, VolOptions: volOptions}}); len(missing) != 0 {
+		t.Errorf("expected no missing volumes without credentials, but got %v", missing)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+	d.cs.commander = &fakeCommander{}
+	d.cs.mounter = &mount.FakeMounter{}
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "csi-cifs-capacity-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretsDir := filepath.Join(dir, "secrets")
+	if err = os.Mkdir(secretsDir, 0755); err != nil {
+		t.Fatalf("failed to create secrets directory: %v", err)
+	}
+	for name, data := range map[string]string{"admin_name": "user", "admin_password": "pass"} {
+		if err = ioutil.WriteFile(filepath.Join(secretsDir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+
+	c := csi.NewControllerClient(conn)
+
+	tests := []struct {
+		name       string
+		req        *csi.GetCapacityRequest
+		secretsDir string
+		code       codes.Code
+		empty      bool
+	}{
+		{
+			name:       "Success with capacity share",
+			req:        &csi.GetCapacityRequest{Parameters: map[string]string{"server": "192.168.122.1", "capacityShare": "data"}},
+			secretsDir: secretsDir,
+			code:       codes.OK,
+		},
+		{
+			// The local path may not be the one on the server
+			name:  "Success with no capacity due to missing capacity share",
+			req:   &csi.GetCapacityRequest{Parameters: map[string]string{"server": "192.168.122.1", "path": dir}},
+			code:  codes.OK,
+			empty: true,
+		},
+		{
+			name:       "Success in subdir mode",
+			req:        &csi.GetCapacityRequest{Parameters: map[string]string{"server": "192.168.122.1", "shareManager": "subdir", "share": "testcapacity"}},
+			secretsDir: secretsDir,
+			code:       codes.OK,
+		},
+		{
+			name: "Success with no capacity due to unsupported access mode",
+			req: &csi.GetCapacityRequest{
+				Parameters: map[string]string{"server": "192.168.122.1", "path": dir},
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_UNKNOWN}},
+				},
+			},
+			code:  codes.OK,
+			empty: true,
+		},
+		{
+			name:  "Success with no capacity due to missing server",
+			req:   &csi.GetCapacityRequest{},
+			code:  codes.OK,
+			empty: true,
+		},
+		{
+			name: "Fail due to missing admin secrets with capacity share",
+			req:  &csi.GetCapacityRequest{Parameters: map[string]string{"server": "192.168.122.2", "capacityShare": "data"}},
+			code: codes.Unavailable,
+		},
+		{
+			name: "Fail due to missing admin secrets in subdir mode",
+			req:  &csi.GetCapacityRequest{Parameters: map[string]string{"server": "192.168.122.2", "shareManager": "subdir", "share": "testcapacity"}},
+			code: codes.Unavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		d.cs.adminSecretsDir = tc.secretsDir
+
+		res, err := c.GetCapacity(context.Background(), tc.req)
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, err)
+			continue
+		}
+		if err == nil && (res.GetAvailableCapacity() == 0) != tc.empty {
+			t.Errorf("%s: unexpected available capacity %d", tc.name, res.GetAvailableCapacity())
 		}
 	}
+
+	// The capacity is cached, so it is still reported after the admin secrets are gone
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove %s: %v", dir, err)
+	}
+	res, err := c.GetCapacity(context.Background(), tests[0].req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if res.GetAvailableCapacity() == 0 {
+		t.Errorf("expected cached available capacity, but got 0")
+	}
 }
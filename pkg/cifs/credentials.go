@@ -0,0 +1,177 @@
+package cifs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	username = "username"
+	password = "password"
+	domain   = "domain"
+
+	admin_name            = "admin_name"
+	admin_password        = "admin_password"
+	admin_domain          = "admin_domain"
+	admin_keytab          = "admin_keytab"
+	admin_machine_account = "admin_machine_account"
+)
+
+type credentials struct {
+	username string
+	password string
+	// domain is the domain or workgroup of username, if not empty
+	domain string
+
+	// keytab is the keytab of the principal username, which `net -k`
+	// authenticates with instead of the password, if not empty
+	keytab []byte
+	// machineAccount makes `net -P` authenticate as the machine account
+	// of the host, which has to be joined to the domain
+	machineAccount bool
+}
+
+func getCredentials(u, p, d string, secrets map[string]string) (*credentials, error) {
+	var (
+		c  = &credentials{domain: secrets[d]}
+		ok bool
+	)
+
+	if c.username, ok = secrets[u]; !ok {
+		return nil, fmt.Errorf("missing username in secrets")
+	}
+
+	if c.password, ok = secrets[p]; !ok {
+		return nil, fmt.Errorf("missing password in secrets")
+	}
+
+	return c, nil
+}
+
+func getUserCredentials(secrets map[string]string) (*credentials, error) {
+	return getCredentials(username, password, domain, secrets)
+}
+
+// getBase64Secret returns the binary secret key, which is base64-encoded
+// since the secrets of CSI calls must be valid UTF-8. Whitespace, such as
+// the line breaks of `base64` output, is ignored.
+func getBase64Secret(secrets map[string]string, key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(secrets[key]), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s in secrets, it must be base64-encoded: %v", key, err)
+	}
+
+	return b, nil
+}
+
+// getAdminCredentials returns the credentials net authenticates with: the
+// machine account if admin_machine_account is true, the base64-encoded
+// admin_keytab of the principal admin_name if set, and admin_name and
+// admin_password otherwise.
+func getAdminCredentials(secrets map[string]string) (*credentials, error) {
+	if v, ok := secrets[admin_machine_account]; ok {
+		machineAccount, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in secrets: %q is not a boolean", admin_machine_account, v)
+		}
+		if machineAccount {
+			return &credentials{machineAccount: true}, nil
+		}
+	}
+
+	if secrets[admin_keytab] != "" {
+		if secrets[admin_name] == "" {
+			return nil, fmt.Errorf("missing %s in secrets, the principal of %s", admin_name, admin_keytab)
+		}
+
+		kt, err := getBase64Secret(secrets, admin_keytab)
+		if err != nil {
+			return nil, err
+		}
+
+		return &credentials{username: secrets[admin_name], domain: secrets[admin_domain], keytab: kt}, nil
+	}
+
+	return getCredentials(admin_name, admin_password, admin_domain, secrets)
+}
+
+// readSecretsDir reads the secrets stored in dir with one file per key,
+// such as a mounted Kubernetes Secret.
+func readSecretsDir(dir string) (map[string]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets from %s: %v", dir, err)
+	}
+
+	secrets := make(map[string]string)
+	for _, fi := range fis {
+		// Kubernetes stores the actual files in hidden directories
+		if strings.HasPrefix(fi.Name(), ".") || fi.IsDir() {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %v", fi.Name(), err)
+		}
+		secrets[fi.Name()] = strings.TrimSuffix(string(b), "\n")
+	}
+
+	return secrets, nil
+}
+
+// writeCredentialsFile writes cr to a temporary file which is readable only by
+// its owner, in the format understood by both `net -A` and `mount.cifs -o credentials=`.
+// The caller is responsible for removing the file once it's no longer needed.
+func writeCredentialsFile(cr *credentials) (string, error) {
+	if len(cr.keytab) > 0 || cr.machineAccount {
+		return "", fmt.Errorf("Kerberos and machine account credentials can only be used by net, a username and a password are required")
+	}
+	if strings.ContainsAny(cr.username, "\r\n") || strings.ContainsAny(cr.password, "\r\n") || strings.ContainsAny(cr.domain, "\r\n") {
+		return "", fmt.Errorf("credentials must not contain line breaks")
+	}
+
+	f, err := ioutil.TempFile("", "csi-cifs-credentials-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create credentials file: %v", err)
+	}
+	defer f.Close()
+
+	if err = f.Chmod(0600); err == nil {
+		_, err = fmt.Fprintf(f, "username=%s\npassword=%s\n", cr.username, cr.password)
+	}
+	if err == nil && cr.domain != "" {
+		_, err = fmt.Fprintf(f, "domain=%s\n", cr.domain)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write credentials file %s: %v", f.Name(), err)
+	}
+
+	return f.Name(), nil
+}
+
+var secretPatterns = []*regexp.Regexp{
+	// mount options: password=PASSWORD
+	regexp.MustCompile(`(pass(word)?=)[^,\s]*`),
+	// net options: -U USER%PASSWORD
+	regexp.MustCompile(`(-U\s*[^%\s]*%)\S*`),
+}
+
+// redactSecrets masks passwords in s so that it can be logged safely.
+func redactSecrets(s string) string {
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, "${1}"+strippedSecret)
+	}
+
+	return s
+}
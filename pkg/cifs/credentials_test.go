@@ -0,0 +1,173 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteCredentialsFile(t *testing.T) {
+	f, err := writeCredentialsFile(&credentials{username: "user", password: "pass"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.Remove(f)
+
+	fi, err := os.Stat(f)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, but got %v", fi.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exp := "username=user\npassword=pass\n"; string(b) != exp {
+		t.Errorf("expected %q, but got %q", exp, string(b))
+	}
+
+	if _, err = writeCredentialsFile(&credentials{username: "user", password: "pass\nusername=foo"}); err == nil {
+		t.Errorf("expected error, but not got any error")
+	}
+	if _, err = writeCredentialsFile(&credentials{username: "user", keytab: []byte("KEYTAB")}); err == nil {
+		t.Errorf("expected error for Kerberos credentials, but not got any error")
+	}
+
+	f, err = writeCredentialsFile(&credentials{username: "user", password: "pass", domain: "EXAMPLE"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.Remove(f)
+
+	if b, err = ioutil.ReadFile(f); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exp := "username=user\npassword=pass\ndomain=EXAMPLE\n"; string(b) != exp {
+		t.Errorf("expected %q, but got %q", exp, string(b))
+	}
+}
+
+func TestGetAdminCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		exp     *credentials
+		errors  bool
+	}{
+		{
+			name:    "Password",
+			secrets: map[string]string{"admin_name": "admin", "admin_password": "pass"},
+			exp:     &credentials{username: "admin", password: "pass"},
+		},
+		{
+			name:    "Password with domain",
+			secrets: map[string]string{"admin_name": "admin", "admin_password": "pass", "admin_domain": "EXAMPLE"},
+			exp:     &credentials{username: "admin", password: "pass", domain: "EXAMPLE"},
+		},
+		{
+			name:    "Keytab",
+			secrets: map[string]string{"admin_name": "admin", "admin_keytab": "S0VZVEFC", "admin_domain": "example.com"},
+			exp:     &credentials{username: "admin", domain: "example.com", keytab: []byte("KEYTAB")},
+		},
+		{
+			name:    "Machine account",
+			secrets: map[string]string{"admin_machine_account": "true"},
+			exp:     &credentials{machineAccount: true},
+		},
+		{
+			name:    "Disabled machine account",
+			secrets: map[string]string{"admin_machine_account": "false", "admin_name": "admin", "admin_password": "pass"},
+			exp:     &credentials{username: "admin", password: "pass"},
+		},
+		{
+			name:    "Fail due to invalid machine account",
+			secrets: map[string]string{"admin_machine_account": "yes please"},
+			errors:  true,
+		},
+		{
+			name:    "Fail due to keytab without principal",
+			secrets: map[string]string{"admin_keytab": "S0VZVEFC"},
+			errors:  true,
+		},
+		{
+			name:    "Fail due to unencoded keytab",
+			secrets: map[string]string{"admin_name": "admin", "admin_keytab": "KEYTAB\x05"},
+			errors:  true,
+		},
+		{
+			name:    "Fail due to missing password",
+			secrets: map[string]string{"admin_name": "admin"},
+			errors:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		cr, err := getAdminCredentials(tc.secrets)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && !reflect.DeepEqual(cr, tc.exp) {
+			t.Errorf("%s: expected %+v, but got %+v", tc.name, tc.exp, cr)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{in: "rpc share list -S server -A /tmp/creds", exp: "rpc share list -S server -A /tmp/creds"},
+		{in: "rpc share list -S server -U root%secret -d 1", exp: "rpc share list -S server -U root%**** -d 1"},
+		{in: "-o username=user,password=secret,vers=3.0", exp: "-o username=user,password=****,vers=3.0"},
+		{in: "-o pass=secret", exp: "-o pass=****"},
+	}
+
+	for _, tc := range tests {
+		if s := redactSecrets(tc.in); s != tc.exp {
+			t.Errorf("expected %q, but got %q", tc.exp, s)
+		}
+	}
+}
+
+func TestReadSecretsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-secrets-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"admin_name":     "user\n",
+		"admin_password": "pass",
+		"admin_keytab":   "S0VZVEFC\n",
+		".hidden":        "foo",
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(dir, "..data"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	secrets, err := readSecretsDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exp := map[string]string{"admin_name": "user", "admin_password": "pass", "admin_keytab": "S0VZVEFC"}; !reflect.DeepEqual(secrets, exp) {
+		t.Errorf("expected %v, but got %v", exp, secrets)
+	}
+
+	if _, err = readSecretsDir(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Errorf("expected error for nonexistent directory, but not got any error")
+	}
+}
@@ -1,12 +1,15 @@
 package cifs
 
 import (
+	"errors"
 	"os"
 	"path"
+	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
@@ -16,6 +19,7 @@ const (
 )
 
 type cifsDriver struct {
+	name   string
 	driver *csicommon.CSIDriver
 
 	server csicommon.NonBlockingGRPCServer
@@ -26,6 +30,10 @@ type cifsDriver struct {
 
 	caps   []*csi.VolumeCapability_AccessMode
 	cscaps []*csi.ControllerServiceCapability
+
+	orphanReconciler      *orphanReconciler
+	kerberosRenewInterval time.Duration
+	stopCh                chan struct{}
 }
 
 func NewCifsDriver() *cifsDriver {
@@ -41,12 +49,29 @@ func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
 func NewControllerServer(d *csicommon.CSIDriver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		locks:                   newOperationLocks(),
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver) *nodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, nl []csi.NodeServiceCapability_RPC_Type) *nodeServer {
+	var caps []*csi.NodeServiceCapability
+	for _, c := range nl {
+		glog.Infof("Enabling node service capability: %v", c.String())
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		mounter:           mount.New(""),
+		caps:              caps,
+		tickets:           newKerberosTickets(kerberosRoot, nil),
+		locks:             newOperationLocks(),
 	}
 }
 
@@ -57,6 +82,8 @@ func createPersistentStorage(persistentStoragePath string) error {
 func (fs *cifsDriver) Init(driverName, nodeId string) {
 	glog.Infof("Driver: %v version: %v", driverName, Version)
 
+	fs.name = driverName
+
 	if err := createPersistentStorage(path.Join(PluginFolder, "controller")); err != nil {
 		glog.Fatalf("failed to create persistent storage for controller: %v", err)
 	}
@@ -69,10 +96,18 @@ func (fs *cifsDriver) Init(driverName, nodeId string) {
 		glog.Fatalf("failed to create persistent storage for controllercache: %v", err)
 	}
 
+	if err := createPersistentStorage(path.Join(PluginFolder, "controller", "snapshot-cache")); err != nil {
+		glog.Fatalf("failed to create persistent storage for snapshotcache: %v", err)
+	}
+
 	if err := loadControllerCache(); err != nil {
 		glog.Errorf("cifs: failed to read volume cache: %v", err)
 	}
 
+	if err := loadSnapshotCache(); err != nil {
+		glog.Errorf("cifs: failed to read snapshot cache: %v", err)
+	}
+
 	fs.driver = csicommon.NewCSIDriver(driverName, Version, nodeId)
 	if fs.driver == nil {
 		glog.Fatalln("Failed to initialize CSI driver")
@@ -80,24 +115,119 @@ func (fs *cifsDriver) Init(driverName, nodeId string) {
 
 	fs.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 	})
 
 	fs.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 	})
 
 	fs.is = NewIdentityServer(fs.driver)
-	fs.ns = NewNodeServer(fs.driver)
+	fs.ns = NewNodeServer(fs.driver, []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	})
 	fs.cs = NewControllerServer(fs.driver)
 
-	fs.server = csicommon.NewNonBlockingGRPCServer()
+	if err := fs.ns.tickets.load(); err != nil {
+		glog.Errorf("cifs: failed to read Kerberos tickets: %v", err)
+	}
+	fs.kerberosRenewInterval = defaultKerberosRenewInterval
+
+	fs.server = newNonBlockingGRPCServer()
+}
+
+// SetAdminSecretsDir sets the directory of the admin credentials used by
+// RPCs which carry no secrets, such as a mounted Secret. It must be called after Init.
+func (fs *cifsDriver) SetAdminSecretsDir(dir string) {
+	fs.cs.adminSecretsDir = dir
+}
+
+// EnableListVolumesCrossCheck makes ListVolumes check that the shares of the
+// listed volumes still exist, with the admin credentials set by SetAdminSecretsDir,
+// and leave out the volumes whose share doesn't. It must be called after Init.
+func (fs *cifsDriver) EnableListVolumesCrossCheck() {
+	fs.cs.crossCheckVolumes = true
+}
+
+// UseConfigMapControllerCache stores the controller and snapshot caches in
+// ConfigMaps in namespace instead of the plugin directory of the node, and
+// reloads them. It must be called after Init.
+func (fs *cifsDriver) UseConfigMapControllerCache(namespace string) error {
+	client, err := newInClusterClient()
+	if err != nil {
+		return err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+
+	ctrCacheStore = newConfigMapControllerCacheStore(configMaps)
+	snapCacheStore = newConfigMapSnapshotCacheStore(configMaps)
+
+	if err = loadControllerCache(); err != nil {
+		return err
+	}
+
+	return loadSnapshotCache()
+}
+
+// EnableOrphanReconciler looks for orphaned shares on the servers of the
+// volumes every interval, with the admin credentials set by SetAdminSecretsDir.
+// Shares orphaned for gracePeriod are reported, and removed if remove is true.
+// If checkPVs is true, the volumes of the PersistentVolumes of the driver are
+// also taken into account, which requires running in a Kubernetes cluster.
+// Removing shares requires checkPVs. It must be called after Init.
+func (fs *cifsDriver) EnableOrphanReconciler(interval, gracePeriod time.Duration, remove, checkPVs bool) error {
+	if remove && !checkPVs {
+		return errors.New("removing orphaned shares requires checking the PersistentVolumes")
+	}
+
+	var listPVs func() ([]volumeID, error)
+
+	if checkPVs {
+		client, err := newInClusterClient()
+		if err != nil {
+			return err
+		}
+
+		listPVs = newPVLister(client, fs.name)
+	}
+
+	fs.orphanReconciler = newOrphanReconciler(fs.cs, interval, gracePeriod, remove, listPVs)
+
+	return nil
+}
+
+// SetKerberosRenewInterval sets the interval at which the tickets of
+// Kerberos mounts are renewed, which has to be shorter than their lifetime.
+// It must be called after Init.
+func (fs *cifsDriver) SetKerberosRenewInterval(interval time.Duration) {
+	fs.kerberosRenewInterval = interval
 }
 
 func (fs *cifsDriver) Start(endpoint string) {
+	fs.stopCh = make(chan struct{})
+	if fs.orphanReconciler != nil {
+		go fs.orphanReconciler.run(fs.stopCh)
+	}
+	go fs.ns.tickets.run(fs.kerberosRenewInterval, fs.stopCh)
+
 	fs.server.Start(endpoint, fs.is, fs.cs, fs.ns)
+
 	fs.server.Wait()
 }
 
 func (fs *cifsDriver) Stop() {
+	if fs.stopCh != nil {
+		close(fs.stopCh)
+	}
 	fs.server.Stop()
 }
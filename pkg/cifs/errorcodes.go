@@ -0,0 +1,177 @@
+package cifs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cifsError is a known failure reported by net, mount.cifs or kinit, with the gRPC
+// code it maps to and a hint on how to fix it.
+type cifsError struct {
+	name string
+	code codes.Code
+	hint string
+}
+
+const (
+	credentialsHint = "check the username and password in the secrets"
+	accountHint     = "the account is disabled, locked out or its password has expired"
+	unreachableHint = "check that the server is reachable from the node and serves SMB on port 445"
+)
+
+// ntStatusErrors are the NT_STATUS and WERR codes printed by net, and by
+// mount.cifs in verbose mode, by name.
+var ntStatusErrors = map[string]cifsError{
+	"NT_STATUS_ACCESS_DENIED":                {code: codes.PermissionDenied, hint: "the user is not allowed to access the share or to manage shares on the server"},
+	"WERR_ACCESS_DENIED":                     {code: codes.PermissionDenied, hint: "the user is not allowed to manage shares on the server"},
+	"NT_STATUS_LOGON_FAILURE":                {code: codes.Unauthenticated, hint: credentialsHint},
+	"NT_STATUS_WRONG_PASSWORD":               {code: codes.Unauthenticated, hint: credentialsHint},
+	"NT_STATUS_NO_SUCH_USER":                 {code: codes.Unauthenticated, hint: credentialsHint},
+	"NT_STATUS_ACCOUNT_DISABLED":             {code: codes.PermissionDenied, hint: accountHint},
+	"NT_STATUS_ACCOUNT_LOCKED_OUT":           {code: codes.PermissionDenied, hint: accountHint},
+	"NT_STATUS_ACCOUNT_EXPIRED":              {code: codes.PermissionDenied, hint: accountHint},
+	"NT_STATUS_PASSWORD_EXPIRED":             {code: codes.PermissionDenied, hint: accountHint},
+	"NT_STATUS_PASSWORD_MUST_CHANGE":         {code: codes.PermissionDenied, hint: accountHint},
+	"NT_STATUS_OBJECT_NAME_COLLISION":        {code: codes.AlreadyExists, hint: "a share or file with the same name already exists on the server"},
+	"WERR_FILE_EXISTS":                       {code: codes.AlreadyExists, hint: "a share or file with the same name already exists on the server"},
+	"WERR_ALREADY_EXISTS":                    {code: codes.AlreadyExists, hint: "a share or file with the same name already exists on the server"},
+	"WERR_NERR_DUPLICATESHARE":               {code: codes.AlreadyExists, hint: "a share with the same name already exists on the server"},
+	"NT_STATUS_BAD_NETWORK_NAME":             {code: codes.NotFound, hint: "the share doesn't exist on the server"},
+	"NT_STATUS_OBJECT_NAME_NOT_FOUND":        {code: codes.NotFound, hint: "the share or directory doesn't exist on the server"},
+	"NT_STATUS_OBJECT_PATH_NOT_FOUND":        {code: codes.NotFound, hint: "the share or directory doesn't exist on the server"},
+	"NT_STATUS_HOST_UNREACHABLE":             {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_NETWORK_UNREACHABLE":          {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_CONNECTION_REFUSED":           {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_CONNECTION_RESET":             {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_CONNECTION_DISCONNECTED":      {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_IO_TIMEOUT":                   {code: codes.Unavailable, hint: unreachableHint},
+	"NT_STATUS_BAD_NETWORK_PATH":             {code: codes.Unavailable, hint: "check the name of the server"},
+	"NT_STATUS_DISK_FULL":                    {code: codes.ResourceExhausted, hint: "the filesystem of the share is full"},
+	"WERR_DISK_FULL":                         {code: codes.ResourceExhausted, hint: "the filesystem of the share is full"},
+	"NT_STATUS_INVALID_PARAMETER":            {code: codes.InvalidArgument, hint: "check the volume parameters"},
+	"WERR_INVALID_PARAMETER":                 {code: codes.InvalidArgument, hint: "check the volume parameters"},
+	"WERR_INVALID_PARAM":                     {code: codes.InvalidArgument, hint: "check the volume parameters"},
+	"WERR_BAD_PATHNAME":                      {code: codes.InvalidArgument, hint: "the path of the share doesn't exist on the server, check the path parameter"},
+	"NT_STATUS_NOT_SUPPORTED":                {code: codes.FailedPrecondition, hint: "the server doesn't support the operation"},
+	"WERR_NOT_SUPPORTED":                     {code: codes.FailedPrecondition, hint: "the server doesn't support the operation, `registry shares = yes` is required to set share options"},
+	"NT_STATUS_NO_LOGON_SERVERS":             {code: codes.Unavailable, hint: "no domain controller is reachable to authenticate the user"},
+	"NT_STATUS_TIME_DIFFERENCE_AT_DC":        {code: codes.FailedPrecondition, hint: "the clocks of the node and the domain controller differ too much"},
+	"NT_STATUS_TRUSTED_RELATIONSHIP_FAILURE": {code: codes.FailedPrecondition, hint: "the server doesn't trust the domain of the user"},
+}
+
+// errnoErrors are the errors reported by mount.cifs as `mount error(ERRNO)`
+// or by the kernel, by errno.
+var errnoErrors = []struct {
+	errno syscall.Errno
+	cifsError
+}{
+	{syscall.EACCES, cifsError{code: codes.PermissionDenied, hint: "the credentials were rejected or the user is not allowed to access the share, " + credentialsHint}},
+	{syscall.EPERM, cifsError{code: codes.PermissionDenied, hint: "the user is not allowed to access the share"}},
+	{syscall.ENOKEY, cifsError{code: codes.Unauthenticated, hint: "no Kerberos ticket is available for the user, check the keytab and the cruid mount option"}},
+	{syscall.EKEYEXPIRED, cifsError{code: codes.Unauthenticated, hint: "the Kerberos ticket of the user has expired"}},
+	{syscall.ENOENT, cifsError{code: codes.NotFound, hint: "the share or directory doesn't exist on the server"}},
+	{syscall.ENXIO, cifsError{code: codes.NotFound, hint: "the share doesn't exist on the server"}},
+	{syscall.EHOSTDOWN, cifsError{code: codes.Unavailable, hint: unreachableHint + ", and that it supports the SMB dialect set by the vers mount option"}},
+	{syscall.EHOSTUNREACH, cifsError{code: codes.Unavailable, hint: unreachableHint}},
+	{syscall.ENETUNREACH, cifsError{code: codes.Unavailable, hint: unreachableHint}},
+	{syscall.ECONNREFUSED, cifsError{code: codes.Unavailable, hint: unreachableHint}},
+	{syscall.ECONNRESET, cifsError{code: codes.Unavailable, hint: unreachableHint}},
+	{syscall.ETIMEDOUT, cifsError{code: codes.Unavailable, hint: unreachableHint}},
+	{syscall.EAGAIN, cifsError{code: codes.Unavailable, hint: "the server is busy, retry later"}},
+	{syscall.ENOSPC, cifsError{code: codes.ResourceExhausted, hint: "the filesystem of the share is full"}},
+	{syscall.EDQUOT, cifsError{code: codes.ResourceExhausted, hint: "the quota of the user is exceeded"}},
+	{syscall.EOPNOTSUPP, cifsError{code: codes.InvalidArgument, hint: "the server doesn't support the mount options, such as the SMB dialect or the security mode"}},
+	{syscall.EINVAL, cifsError{code: codes.InvalidArgument, hint: "check the mount options"}},
+	{syscall.ENODEV, cifsError{code: codes.FailedPrecondition, hint: "the cifs kernel module is not available on the node"}},
+}
+
+// messageErrors are the errors which are only reported as messages, such as
+// the errors of kinit.
+var messageErrors = []struct {
+	message string
+	cifsError
+}{
+	{"could not resolve address", cifsError{name: "unresolvable server", code: codes.Unavailable, hint: "check the name of the server"}},
+	{"cifs filesystem not supported", cifsError{name: "cifs not supported", code: codes.FailedPrecondition, hint: "the cifs kernel module is not available on the node"}},
+	{"preauthentication failed", cifsError{name: "Kerberos preauthentication failed", code: codes.Unauthenticated, hint: "check the password or the keytab of the principal"}},
+	{"not found in kerberos database", cifsError{name: "unknown principal", code: codes.Unauthenticated, hint: "check the principal in the secrets"}},
+	{"no suitable keys", cifsError{name: "unusable keytab", code: codes.InvalidArgument, hint: "the keytab has no keys for the principal"}},
+	{"ticket expired", cifsError{name: "Kerberos ticket expired", code: codes.Unauthenticated, hint: "the ticket in the credential cache has expired and can't be renewed"}},
+	{"cannot contact any kdc", cifsError{name: "KDC unreachable", code: codes.Unavailable, hint: "check the realm and the KDCs in the krb5.conf of the node"}},
+	{"cannot find kdc", cifsError{name: "KDC unreachable", code: codes.Unavailable, hint: "check the realm and the KDCs in the krb5.conf of the node"}},
+	{"clock skew too great", cifsError{name: "clock skew", code: codes.FailedPrecondition, hint: "the clocks of the node and the KDC differ too much"}},
+	{"wrong fs type", cifsError{name: "mount failed", code: codes.FailedPrecondition, hint: "check that cifs-utils is installed on the node and the mount options"}},
+}
+
+var (
+	ntStatusRe   = regexp.MustCompile(`\b(?:NT_STATUS|WERR)_[A-Z_]+\b`)
+	mountErrorRe = regexp.MustCompile(`mount error\((\d+)\)`)
+)
+
+// classifyCifsError returns the first known NT_STATUS or WERR code in out,
+// otherwise the errno of `mount error(ERRNO)` or of an error message in out.
+func classifyCifsError(out string) (*cifsError, bool) {
+	for _, name := range ntStatusRe.FindAllString(out, -1) {
+		if e, ok := ntStatusErrors[name]; ok {
+			e.name = name
+			return &e, true
+		}
+	}
+
+	if m := mountErrorRe.FindStringSubmatch(out); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			for _, e := range errnoErrors {
+				if e.errno == syscall.Errno(n) {
+					return errnoError(e.errno, e.cifsError), true
+				}
+			}
+		}
+	}
+
+	lower := strings.ToLower(out)
+	for _, e := range errnoErrors {
+		if strings.Contains(lower, e.errno.Error()) {
+			return errnoError(e.errno, e.cifsError), true
+		}
+	}
+	for _, e := range messageErrors {
+		if strings.Contains(lower, e.message) {
+			ce := e.cifsError
+			return &ce, true
+		}
+	}
+
+	return nil, false
+}
+
+func errnoError(errno syscall.Errno, e cifsError) *cifsError {
+	e.name = errno.Error()
+	return &e
+}
+
+// cifsStatusError returns the failure msg of net or mount.cifs as a gRPC
+// error with the code of the error classified from msg, prefixed with a
+// hint on how to fix it. Unknown errors are returned with code.
+func cifsStatusError(code codes.Code, msg string) error {
+	e, ok := classifyCifsError(msg)
+	if !ok {
+		return status.Error(code, msg)
+	}
+
+	return status.Errorf(e.code, "%s: %s: %s", e.name, e.hint, msg)
+}
+
+// classifyCommandError is commandError for net and kinit, classifying the
+// failure from the output out of cmd.
+func classifyCommandError(cmd string, err error, out []byte) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return cifsStatusError(codes.Internal, commandErrorMessage(cmd, err, out))
+}
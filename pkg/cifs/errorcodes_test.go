@@ -0,0 +1,66 @@
+package cifs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCifsStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		code codes.Code
+		hint string
+	}{
+		{name: "Access denied", msg: "Failed to add share: NT_STATUS_ACCESS_DENIED", code: codes.PermissionDenied, hint: "NT_STATUS_ACCESS_DENIED"},
+		{name: "Logon failure", msg: "Could not connect to server 192.168.122.1\nConnection failed: NT_STATUS_LOGON_FAILURE", code: codes.Unauthenticated, hint: credentialsHint},
+		{name: "Name collision", msg: "Error: NT_STATUS_OBJECT_NAME_COLLISION", code: codes.AlreadyExists, hint: "already exists"},
+		{name: "Host unreachable", msg: "Connection to 192.168.122.1 failed (Error NT_STATUS_HOST_UNREACHABLE)", code: codes.Unavailable, hint: unreachableHint},
+		{name: "Unknown NT_STATUS before known one", msg: "NT_STATUS_UNSUCCESSFUL\nNT_STATUS_IO_TIMEOUT", code: codes.Unavailable, hint: "NT_STATUS_IO_TIMEOUT"},
+		{name: "Registry shares disabled", msg: "Error in setparm: WERR_NOT_SUPPORTED", code: codes.FailedPrecondition, hint: "registry shares"},
+		{name: "EACCES", msg: "mount failed: exit status 32\nOutput: mount error(13): Permission denied", code: codes.PermissionDenied, hint: "permission denied"},
+		{name: "EHOSTDOWN", msg: "mount error(112): Host is down", code: codes.Unavailable, hint: "vers mount option"},
+		{name: "ENOKEY", msg: "mount error(126): Required key not available", code: codes.Unauthenticated, hint: "keytab"},
+		{name: "ENOENT", msg: "mount error(2): No such file or directory", code: codes.NotFound, hint: "doesn't exist"},
+		{name: "EINVAL", msg: "mount error(22): Invalid argument", code: codes.InvalidArgument, hint: "mount options"},
+		{name: "Errno message", msg: "mount: /mnt: cannot mount //server/share: No route to host", code: codes.Unavailable, hint: unreachableHint},
+		{name: "Unresolvable server", msg: "mount error: could not resolve address for nonexistent: Unknown error", code: codes.Unavailable, hint: "name of the server"},
+		{name: "Kerberos preauthentication", msg: "kinit: Preauthentication failed while getting initial credentials", code: codes.Unauthenticated, hint: "keytab"},
+		{name: "KDC unreachable", msg: "kinit: Cannot contact any KDC for realm 'EXAMPLE.COM' while getting initial credentials", code: codes.Unavailable, hint: "krb5.conf"},
+		{name: "Unknown error", msg: "something went wrong", code: codes.Internal, hint: ""},
+	}
+
+	for _, tc := range tests {
+		err := cifsStatusError(codes.Internal, tc.msg)
+
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, code)
+		}
+		if msg := status.Convert(err).Message(); !strings.Contains(msg, tc.hint) || !strings.Contains(msg, tc.msg) {
+			t.Errorf("%s: expected message containing %q and %q, but got %q", tc.name, tc.hint, tc.msg, msg)
+		}
+	}
+}
+
+func TestClassifyCommandError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		out  string
+		code codes.Code
+	}{
+		{name: "Classified error", err: errors.New("exit status 255"), out: "NT_STATUS_WRONG_PASSWORD", code: codes.Unauthenticated},
+		{name: "Unknown error", err: errors.New("exit status 255"), out: "failed", code: codes.Internal},
+		{name: "gRPC error", err: status.Error(codes.DeadlineExceeded, "net timed out"), out: "NT_STATUS_WRONG_PASSWORD", code: codes.DeadlineExceeded},
+	}
+
+	for _, tc := range tests {
+		if code := status.Code(classifyCommandError("net", tc.err, []byte(tc.out))); code != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, code)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package cifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	principal = "principal"
+	keytab    = "keytab"
+	krb5cc    = "krb5cc"
+
+	// kerberosRoot holds the credential caches of Kerberos mounts. The
+	// krb5.conf of the node has to point cifs.upcall to them with
+	// default_ccache_name = FILE:/var/lib/kubelet/plugins/csi-cifsplugin/krb5/krb5cc_%{uid}
+	kerberosRoot = PluginFolder + "/krb5"
+
+	// kerberosTicketsDir is the directory within kerberosRoot which records
+	// the tickets to renew, so that they are renewed after restarts
+	kerberosTicketsDir = "tickets"
+
+	// Kerberos mounts are owned by per-volume cruids in
+	// [kerberosUIDBase, 2*kerberosUIDBase), so that each volume has its own
+	// credential cache
+	kerberosUIDBase = 1 << 30
+
+	defaultKerberosRenewInterval = time.Hour
+)
+
+// kerberosCredentials are the credentials a Kerberos ticket is obtained with,
+// from the node stage secrets.
+type kerberosCredentials struct {
+	principal string
+	password  string
+	keytab    []byte
+	// ccache is a credential cache holding a ticket obtained beforehand
+	ccache []byte
+}
+
+// getKerberosCredentials returns the Kerberos credentials in secrets: a
+// keytab, a password or a credential cache, the former and the latter
+// base64-encoded. The principal defaults to the username, and is only
+// optional with a credential cache.
+func getKerberosCredentials(secrets map[string]string) (*kerberosCredentials, error) {
+	kc := &kerberosCredentials{
+		principal: secrets[principal],
+		password:  secrets[password],
+	}
+
+	var err error
+	if kc.keytab, err = getBase64Secret(secrets, keytab); err != nil {
+		return nil, err
+	}
+	if kc.ccache, err = getBase64Secret(secrets, krb5cc); err != nil {
+		return nil, err
+	}
+
+	if kc.principal == "" {
+		kc.principal = secrets[username]
+	}
+
+	if len(kc.keytab) == 0 && kc.password == "" && len(kc.ccache) == 0 {
+		return nil, fmt.Errorf("missing %s, %s or %s in secrets for Kerberos authentication", keytab, password, krb5cc)
+	}
+	if kc.principal == "" && len(kc.ccache) == 0 {
+		return nil, fmt.Errorf("missing %s or %s in secrets for Kerberos authentication", principal, username)
+	}
+	if strings.HasPrefix(kc.principal, "-") {
+		return nil, fmt.Errorf("invalid principal %q", kc.principal)
+	}
+
+	return kc, nil
+}
+
+// isKerberosMount reports whether the mount options mo select Kerberos authentication.
+func isKerberosMount(mo []string) bool {
+	for _, opt := range mo {
+		if strings.HasPrefix(opt, "sec=krb5") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kerberosUID returns the cruid of the Kerberos mount of the volume volId.
+// It is derived from the volume ID so that it is stable across restarts.
+func kerberosUID(volId volumeID) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(volId))
+
+	return kerberosUIDBase + h.Sum32()%kerberosUIDBase
+}
+
+// kerberosTicket is the ticket of the Kerberos mount of a volume.
+type kerberosTicket struct {
+	VolumeID  volumeID
+	Principal string
+	UID       uint32
+	// Keytab is true if a new ticket can be obtained from the keytab,
+	// otherwise the ticket can only be renewed
+	Keytab bool
+}
+
+// kerberosTickets obtains and renews the tickets of Kerberos mounts, in a
+// credential cache per volume.
+type kerberosTickets struct {
+	root      string
+	commander Interface
+
+	mtx     sync.Mutex
+	tickets map[volumeID]*kerberosTicket
+}
+
+// newKerberosTickets returns the tickets stored in root.
+// If c is not nil, it is used to run all the kinit commands.
+func newKerberosTickets(root string, c Interface) *kerberosTickets {
+	return &kerberosTickets{root: root, commander: c, tickets: make(map[volumeID]*kerberosTicket)}
+}
+
+func (m *kerberosTickets) ccachePath(uid uint32) string {
+	return filepath.Join(m.root, "krb5cc_"+strconv.FormatUint(uint64(uid), 10))
+}
+
+func (m *kerberosTickets) keytabPath(uid uint32) string {
+	return filepath.Join(m.root, "keytab_"+strconv.FormatUint(uint64(uid), 10))
+}
+
+func (m *kerberosTickets) ticketPath(uid uint32) string {
+	return filepath.Join(m.root, kerberosTicketsDir, strconv.FormatUint(uint64(uid), 10)+".json")
+}
+
+// createDirs creates root, which cifs.upcall traverses as the cruids of the
+// mounts, and the directory of the tickets.
+func (m *kerberosTickets) createDirs() error {
+	if err := os.MkdirAll(m.root, 0711); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(filepath.Join(m.root, kerberosTicketsDir), 0700)
+}
+
+// load reads the tickets to renew from root.
+func (m *kerberosTickets) load() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := m.createDirs(); err != nil {
+		return err
+	}
+
+	return loadCacheDir(filepath.Join(m.root, kerberosTicketsDir), func(data []byte) error {
+		t := &kerberosTicket{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return err
+		}
+
+		m.tickets[t.VolumeID] = t
+		return nil
+	})
+}
+
+// kinit runs kinit with args, writing stdin to its standard input.
+// If c is not nil, it is used to run the command.
+func kinit(ctx context.Context, c Interface, stdin []byte, args ...string) error {
+	if c == nil {
+		c = &commander{cmd: "kinit", options: args, stdin: stdin}
+	}
+
+	if out, err := c.execCommand(ctx); err != nil {
+		return classifyCommandError("kinit", err, out)
+	}
+
+	return nil
+}
+
+func (m *kerberosTickets) kinit(ctx context.Context, stdin []byte, args ...string) error {
+	return kinit(ctx, m.commander, stdin, args...)
+}
+
+// obtain stores a ticket for the volume volId obtained with kc in the
+// credential cache of the volume, and returns it.
+func (m *kerberosTickets) obtain(ctx context.Context, volId volumeID, kc *kerberosCredentials) (*kerberosTicket, error) {
+	t := &kerberosTicket{VolumeID: volId, Principal: kc.principal, UID: kerberosUID(volId), Keytab: len(kc.keytab) > 0}
+
+	if err := m.createDirs(); err != nil {
+		return nil, fmt.Errorf("failed to create Kerberos directory %s: %v", m.root, err)
+	}
+
+	ccache := m.ccachePath(t.UID)
+
+	var err error
+	switch {
+	case t.Keytab:
+		if err = writeFileAtomic(m.keytabPath(t.UID), kc.keytab); err != nil {
+			return nil, fmt.Errorf("failed to write keytab of volume %s: %v", volId, err)
+		}
+		// $ kinit -k -t KEYTAB -c FILE:CCACHE PRINCIPAL
+		err = m.kinit(ctx, nil, "-k", "-t", m.keytabPath(t.UID), "-c", "FILE:"+ccache, t.Principal)
+	case len(kc.ccache) > 0:
+		err = writeFileAtomic(ccache, kc.ccache)
+	default:
+		// $ kinit -c FILE:CCACHE PRINCIPAL < PASSWORD
+		err = m.kinit(ctx, []byte(kc.password+"\n"), "-c", "FILE:"+ccache, t.Principal)
+	}
+	if err == nil {
+		// cifs.upcall reads the credential cache as the cruid
+		err = os.Chown(ccache, int(t.UID), -1)
+	}
+	if err != nil {
+		m.remove(t)
+		// kinit failures are already classified
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to obtain a Kerberos ticket for volume %s: %v", volId, err)
+	}
+
+	data, err := json.Marshal(t)
+	if err == nil {
+		err = writeFileAtomic(m.ticketPath(t.UID), data)
+	}
+	if err != nil {
+		m.remove(t)
+		return nil, fmt.Errorf("failed to record the Kerberos ticket of volume %s: %v", volId, err)
+	}
+
+	m.mtx.Lock()
+	m.tickets[volId] = t
+	m.mtx.Unlock()
+
+	return t, nil
+}
+
+// release stops renewing the ticket of the volume volId and removes its
+// credential cache.
+func (m *kerberosTickets) release(volId volumeID) {
+	m.mtx.Lock()
+	t, ok := m.tickets[volId]
+	delete(m.tickets, volId)
+	m.mtx.Unlock()
+
+	if ok {
+		m.remove(t)
+	}
+}
+
+func (m *kerberosTickets) remove(t *kerberosTicket) {
+	for _, p := range []string{m.ticketPath(t.UID), m.ccachePath(t.UID), m.keytabPath(t.UID)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("cifs: failed to remove %s of volume %s: %v", p, t.VolumeID, err)
+		}
+	}
+}
+
+// renew obtains a new ticket from the keytab, or renews the ticket in the
+// credential cache otherwise, which only works within its renewable lifetime.
+func (m *kerberosTickets) renew(ctx context.Context, t *kerberosTicket) error {
+	ccache := m.ccachePath(t.UID)
+
+	var err error
+	if t.Keytab {
+		// $ kinit -k -t KEYTAB -c FILE:CCACHE PRINCIPAL
+		err = m.kinit(ctx, nil, "-k", "-t", m.keytabPath(t.UID), "-c", "FILE:"+ccache, t.Principal)
+	} else {
+		// $ kinit -R -c FILE:CCACHE
+		err = m.kinit(ctx, nil, "-R", "-c", "FILE:"+ccache)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(ccache, int(t.UID), -1)
+}
+
+// renewAll renews all the tickets, and returns the volumes whose ticket
+// couldn't be renewed.
+func (m *kerberosTickets) renewAll(ctx context.Context) []volumeID {
+	m.mtx.Lock()
+	tickets := make([]*kerberosTicket, 0, len(m.tickets))
+	for _, t := range m.tickets {
+		tickets = append(tickets, t)
+	}
+	m.mtx.Unlock()
+
+	var failed []volumeID
+	for _, t := range tickets {
+		if err := m.renew(ctx, t); err != nil {
+			glog.Errorf("cifs: failed to renew the Kerberos ticket of volume %s: %v", t.VolumeID, err)
+			failed = append(failed, t.VolumeID)
+		}
+	}
+
+	return failed
+}
+
+// run renews the tickets every interval until stopCh is closed. The
+// interval has to be shorter than the lifetime of the tickets.
+func (m *kerberosTickets) run(interval time.Duration, stopCh <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+			m.renewAll(context.Background())
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGetKerberosCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		secrets   map[string]string
+		principal string
+		errors    bool
+	}{
+		{name: "Keytab", secrets: map[string]string{"principal": "user@EXAMPLE.COM", "keytab": "S0VZ\nVEFC\n"}, principal: "user@EXAMPLE.COM", errors: false},
+		{name: "Password with username", secrets: map[string]string{"username": "user", "password": "pass"}, principal: "user", errors: false},
+		{name: "Credential cache", secrets: map[string]string{"krb5cc": "Q0NBQ0hF"}, principal: "", errors: false},
+		{name: "Fail due to unencoded credential cache", secrets: map[string]string{"krb5cc": "CCACHE\x05"}, errors: true},
+		{name: "Fail due to missing credentials", secrets: map[string]string{"principal": "user@EXAMPLE.COM"}, errors: true},
+		{name: "Fail due to missing principal", secrets: map[string]string{"keytab": "S0VZVEFC"}, errors: true},
+		{name: "Fail due to invalid principal", secrets: map[string]string{"principal": "-V", "password": "pass"}, errors: true},
+	}
+
+	for _, tc := range tests {
+		kc, err := getKerberosCredentials(tc.secrets)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && kc.principal != tc.principal {
+			t.Errorf("%s: expected principal %q, but got %q", tc.name, tc.principal, kc.principal)
+		}
+	}
+}
+
+func TestIsKerberosMount(t *testing.T) {
+	tests := []struct {
+		mo  []string
+		exp bool
+	}{
+		{mo: []string{"sec=krb5", "vers=3.0"}, exp: true},
+		{mo: []string{"sec=krb5i"}, exp: true},
+		{mo: []string{"sec=ntlmssp"}, exp: false},
+		{mo: nil, exp: false},
+	}
+
+	for _, tc := range tests {
+		if got := isKerberosMount(tc.mo); got != tc.exp {
+			t.Errorf("%v: expected %v, but got %v", tc.mo, tc.exp, got)
+		}
+	}
+}
+
+func TestKerberosUID(t *testing.T) {
+	a, b := kerberosUID("csi-cifs-a"), kerberosUID("csi-cifs-b")
+	for _, uid := range []uint32{a, b} {
+		if uid < kerberosUIDBase || uid >= 2*kerberosUIDBase {
+			t.Errorf("expected a cruid in [%d, %d), but got %d", kerberosUIDBase, 2*kerberosUIDBase, uid)
+		}
+	}
+	if a == b {
+		t.Errorf("expected different cruids, but got %d for both", a)
+	}
+	if a != kerberosUID("csi-cifs-a") {
+		t.Errorf("expected stable cruids")
+	}
+}
+
+func TestKerberosTickets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-krb5-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newKerberosTickets(dir, &fakeCommander{})
+
+	// kinit is faked, so the credential cache it would create is created beforehand
+	if err = ioutil.WriteFile(m.ccachePath(kerberosUID("keytabvol")), []byte("CCACHE"), 0600); err != nil {
+		t.Fatalf("failed to create credential cache: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		volId volumeID
+		kc    *kerberosCredentials
+	}{
+		{name: "Keytab", volId: "keytabvol", kc: &kerberosCredentials{principal: "user@EXAMPLE.COM", keytab: []byte("KEYTAB")}},
+		{name: "Credential cache", volId: "ccachevol", kc: &kerberosCredentials{ccache: []byte("CCACHE")}},
+	}
+
+	for _, tc := range tests {
+		tk, err := m.obtain(context.Background(), tc.volId, tc.kc)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		fi, err := os.Stat(m.ccachePath(tk.UID))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if uid := fi.Sys().(*syscall.Stat_t).Uid; uid != tk.UID {
+			t.Errorf("%s: expected the credential cache to be owned by %d, but got %d", tc.name, tk.UID, uid)
+		}
+	}
+
+	if failed := m.renewAll(context.Background()); len(failed) != 0 {
+		t.Errorf("expected all the tickets to be renewed, but %v were not", failed)
+	}
+
+	// The tickets are renewed after restarts
+	loaded := newKerberosTickets(dir, &fakeCommander{})
+	if err = loaded.load(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(loaded.tickets) != len(tests) {
+		t.Errorf("expected %d tickets, but got %v", len(tests), loaded.tickets)
+	}
+	if tk := loaded.tickets["keytabvol"]; tk == nil || !tk.Keytab || tk.Principal != "user@EXAMPLE.COM" {
+		t.Errorf("expected the keytab ticket to be loaded, but got %+v", tk)
+	}
+
+	m.release("keytabvol")
+	for _, p := range []string{m.ccachePath(kerberosUID("keytabvol")), m.keytabPath(kerberosUID("keytabvol")), m.ticketPath(kerberosUID("keytabvol"))} {
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, but got %v", p, err)
+		}
+	}
+	if _, ok := m.tickets["ccachevol"]; !ok {
+		t.Errorf("expected the ticket of ccachevol to be kept")
+	}
+}
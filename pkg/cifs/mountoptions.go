@@ -0,0 +1,213 @@
+package cifs
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mountParameter is a StorageClass parameter which is passed to mount.cifs.
+type mountParameter struct {
+	// values are the allowed values, if not empty
+	values []string
+	// validate validates the value, if not nil
+	validate func(string) error
+	// flags are the mount options set when the parameter is true and
+	// false respectively, for boolean parameters. Empty flags are omitted.
+	flags []string
+}
+
+// mountParameters are the StorageClass parameters which are passed to mount.cifs.
+var mountParameters = map[string]mountParameter{
+	"vers":      {values: []string{"1.0", "2.0", "2.1", "3", "3.0", "3.02", "3.1.1", "default"}},
+	"sec":       {values: []string{"none", "krb5", "krb5i", "ntlm", "ntlmi", "ntlmv2", "ntlmv2i", "ntlmssp", "ntlmsspi"}},
+	"uid":       {validate: validateMountOwner},
+	"gid":       {validate: validateMountOwner},
+	"file_mode": {validate: validateMountMode},
+	"dir_mode":  {validate: validateMountMode},
+	"cache":     {values: []string{"none", "strict", "loose"}},
+	"actimeo":   {validate: validateMountUint},
+	"rsize":     {validate: validateMountUint},
+	"wsize":     {validate: validateMountUint},
+	"nobrl":     {flags: []string{"nobrl", "brl"}},
+	"serverino": {flags: []string{"serverino", "noserverino"}},
+	"seal":      {flags: []string{"seal", ""}},
+}
+
+// forbiddenMountOptions are set by the driver itself from the secrets.
+var forbiddenMountOptions = map[string]bool{
+	"user":        true,
+	"username":    true,
+	"pass":        true,
+	"password":    true,
+	"credentials": true,
+	"cred":        true,
+	"cruid":       true,
+}
+
+var (
+	mountOwnerRe = regexp.MustCompile(`^([0-9]+|[a-z_][a-z0-9_-]*\$?)$`)
+	mountModeRe  = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+)
+
+func validateMountOwner(v string) error {
+	if !mountOwnerRe.MatchString(v) {
+		return fmt.Errorf("%q is neither a numeric ID nor a name", v)
+	}
+	return nil
+}
+
+func validateMountMode(v string) error {
+	if !mountModeRe.MatchString(v) {
+		return fmt.Errorf("%q is not an octal mode", v)
+	}
+	return nil
+}
+
+func validateMountUint(v string) error {
+	if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+		return fmt.Errorf("%q is not an unsigned integer", v)
+	}
+	return nil
+}
+
+func (p *mountParameter) validateValue(v string) error {
+	if p.validate != nil {
+		return p.validate(v)
+	}
+
+	for _, allowed := range p.values {
+		if v == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not one of %v", v, p.values)
+}
+
+// mountOptions maps the name of mount options to the options themselves,
+// so that conflicting options are detected.
+type mountOptions map[string]string
+
+func (mo mountOptions) add(name, opt string) error {
+	if prev, ok := mo[name]; ok && prev != opt {
+		return fmt.Errorf("conflicting values for mount option %s: %q and %q", name, prev, opt)
+	}
+
+	mo[name] = opt
+	return nil
+}
+
+// list returns the mount options, sorted.
+func (mo mountOptions) list() []string {
+	var opts []string
+	for _, opt := range mo {
+		if opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	sort.Strings(opts)
+
+	return opts
+}
+
+// mountParameterName returns the name of the mount parameter which sets the flag opt.
+func mountParameterName(opt string) (string, bool) {
+	for name, p := range mountParameters {
+		for _, flag := range p.flags {
+			if flag != "" && flag == opt {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// addMountParameters adds the mount options set by the StorageClass parameters params.
+func (mo mountOptions) addMountParameters(params map[string]string) error {
+	for name, v := range params {
+		p, ok := mountParameters[name]
+		if !ok {
+			continue
+		}
+
+		if p.flags != nil {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for mount parameter %s: %q is not a boolean", name, v)
+			}
+
+			flag := p.flags[0]
+			if !b {
+				flag = p.flags[1]
+			}
+			if err = mo.add(name, flag); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.validateValue(v); err != nil {
+			return fmt.Errorf("invalid value for mount parameter %s: %v", name, err)
+		}
+		if err := mo.add(name, name+"="+v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addMountFlags adds the mount flags of a volume capability.
+func (mo mountOptions) addMountFlags(flags []string) error {
+	for _, f := range flags {
+		for _, opt := range strings.Split(f, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" {
+				continue
+			}
+
+			kv := strings.SplitN(opt, "=", 2)
+			name := kv[0]
+
+			if forbiddenMountOptions[name] {
+				return fmt.Errorf("mount option %s is not allowed, credentials are read from the secrets", name)
+			}
+
+			if p, ok := mountParameters[name]; ok && p.flags == nil {
+				if len(kv) != 2 {
+					return fmt.Errorf("mount option %s requires a value", name)
+				}
+				if err := p.validateValue(kv[1]); err != nil {
+					return fmt.Errorf("invalid value for mount option %s: %v", name, err)
+				}
+			} else if pname, ok := mountParameterName(opt); ok {
+				name = pname
+			}
+
+			if err := mo.add(name, opt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getMountOptions returns the mount.cifs options set by the StorageClass
+// parameters params and the volume capability mount flags.
+func getMountOptions(params map[string]string, flags []string) ([]string, error) {
+	mo := make(mountOptions)
+
+	if err := mo.addMountParameters(params); err != nil {
+		return nil, err
+	}
+	if err := mo.addMountFlags(flags); err != nil {
+		return nil, err
+	}
+
+	return mo.list(), nil
+}
@@ -0,0 +1,93 @@
+package cifs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetMountOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		flags  []string
+		exp    []string
+		errors bool
+	}{
+		{
+			name:   "Success without options",
+			params: map[string]string{"server": "example.com"},
+			exp:    nil,
+		},
+		{
+			name:   "Success with parameters",
+			params: map[string]string{"server": "example.com", "vers": "3.0", "uid": "1000", "file_mode": "0644", "nobrl": "true", "serverino": "false", "seal": "false"},
+			exp:    []string{"file_mode=0644", "nobrl", "noserverino", "uid=1000", "vers=3.0"},
+		},
+		{
+			name:  "Success with mount flags",
+			flags: []string{"vers=2.1,cache=strict", "noperm", "serverino"},
+			exp:   []string{"cache=strict", "noperm", "serverino", "vers=2.1"},
+		},
+		{
+			name:   "Success with same option in parameters and mount flags",
+			params: map[string]string{"vers": "3.0", "seal": "true"},
+			flags:  []string{"vers=3.0", "seal"},
+			exp:    []string{"seal", "vers=3.0"},
+		},
+		{
+			name:   "Fail due to invalid parameter",
+			params: map[string]string{"vers": "4.0"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to non-boolean parameter",
+			params: map[string]string{"nobrl": "yes please"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to invalid mode",
+			params: map[string]string{"dir_mode": "rwxr-xr-x"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to invalid mount flag",
+			flags:  []string{"rsize=big"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to conflicting parameter and mount flag",
+			params: map[string]string{"vers": "3.0"},
+			flags:  []string{"vers=2.1"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to conflicting boolean parameter and mount flag",
+			params: map[string]string{"serverino": "true"},
+			flags:  []string{"noserverino"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to conflicting mount flags",
+			flags:  []string{"cache=none", "cache=loose"},
+			errors: true,
+		},
+		{
+			name:   "Fail due to password in mount flags",
+			flags:  []string{"password=secret"},
+			errors: true,
+		},
+	}
+
+	for _, tc := range tests {
+		mo, err := getMountOptions(tc.params, tc.flags)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && !reflect.DeepEqual(mo, tc.exp) {
+			t.Errorf("%s: expected %v, but got %v", tc.name, tc.exp, mo)
+		}
+	}
+}
@@ -5,131 +5,250 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"syscall"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume/util"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type nodeServer struct {
-	cr *credentials
 	*csicommon.DefaultNodeServer
 
 	mounter mount.Interface
+	caps    []*csi.NodeServiceCapability
+	tickets *kerberosTickets
+
+	locks *operationLocks
 }
 
 type volumeID string
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := validateNodeStageVolumeRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	release, err := ns.locks.acquire(volumeLock(volumeID(req.GetVolumeId())))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stagingTargetPath := req.GetStagingTargetPath()
+	volId := req.GetVolumeId()
+
+	notMnt, err := ensureMountPoint(ns.mounter, stagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		glog.Infof("cifs: volume %s is already mounted to %s", volId, stagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	volOptions, err := getNodeVolumeOptions(volumeID(volId), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mo, err := getMountOptions(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if isReadOnlyAccessMode(req.GetVolumeCapability()) {
+		mo = append(mo, "ro")
+	}
+
+	source := cifsSource(volOptions.Server, volOptions.Share, volOptions.Subdir)
+
+	if isKerberosMount(mo) {
+		if err = ns.mountKerberos(ctx, volumeID(volId), source, stagingTargetPath, req.GetSecrets(), mo); err != nil {
+			return nil, err
+		}
+
+		glog.Infof("cifs: successfully mounted volume %s to %s with Kerberos", volId, stagingTargetPath)
+
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	cr, err := getUserCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to get user credentials from node stage secrets: %v", err)
+	}
+	if cr.username == "" || cr.password == "" {
+		return nil, status.Error(codes.InvalidArgument, "username and password are required in node stage secrets unless sec=krb5 is used")
+	}
+
+	if err = mountCifs(ctx, ns.mounter, source, stagingTargetPath, cr, mo); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("cifs: successfully mounted volume %s to %s", volId, stagingTargetPath)
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	glog.Infof("publish")
-
 	if err := validateNodePublishVolumeRequest(req); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if ns.mounter == nil {
-		ns.mounter = mount.New("")
+	release, err := ns.locks.acquire(volumeLock(volumeID(req.GetVolumeId())))
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
 	targetPath := req.GetTargetPath()
 	volId := req.GetVolumeId()
 
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	notMnt, err := ensureMountPoint(ns.mounter, targetPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !notMnt {
 		glog.Infof("cifs: volume %s is already bind-mounted to %s", volId, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	ns.cr, err = getUserCredentials(req.GetNodePublishSecrets())
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user credentials from node stage secrets: %v", err)
+	// The staging path is shared by all the publications of the volume,
+	// so read-only publications are read-only bind mounts.
+	mo := []string{"bind"}
+	if req.GetReadonly() || isReadOnlyAccessMode(req.GetVolumeCapability()) {
+		mo = append(mo, "ro")
 	}
-	if ns.cr.username == "" || ns.cr.password == "" {
-		return nil, fmt.Errorf("TODO: need to auth")
+
+	if err = ns.mounter.Mount(req.GetStagingTargetPath(), targetPath, "", mo); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	mo := []string{}
-	mo = append(mo, fmt.Sprintf("username=%s", ns.cr.username))
-	mo = append(mo, fmt.Sprintf("password=%s", ns.cr.password))
+	glog.Infof("cifs: successfully bind-mounted volume %s to %s", volId, targetPath)
 
-	s := req.GetVolumeAttributes()["server"]
-	if s == "" {
-		return nil, fmt.Errorf("TODO: need server or endpoint")
-	}
-	source := fmt.Sprintf("//%s/%s", s, volId)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
-	err = ns.mounter.Mount(source, targetPath, "cifs", mo)
+// ensureMountPoint creates mountPath if it doesn't exist and reports
+// whether it is not a mount point.
+func ensureMountPoint(mounter mount.Interface, mountPath string) (bool, error) {
+	notMnt, err := mounter.IsLikelyNotMountPoint(mountPath)
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
+		if !os.IsNotExist(err) {
+			return false, err
 		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		if err = os.MkdirAll(mountPath, 0750); err != nil {
+			return false, err
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		notMnt = true
 	}
 
-	glog.Infof("cifs: successfully mounted volume %s to %s", volId, targetPath)
-
-	return &csi.NodePublishVolumeResponse{}, nil
+	return notMnt, nil
 }
 
-const (
-	username = "username"
-	password = "password"
+// getNodeVolumeOptions returns where the volume volId is exported. Versioned
+// volume IDs encode it, otherwise it's read from the volume context.
+func getNodeVolumeOptions(volId volumeID, volCtx map[string]string) (*volumeOptions, error) {
+	if isVersionedVolumeID(volId) {
+		return decodeVolumeID(volId)
+	}
 
-	admin_name     = "admin_name"
-	admin_password = "admin_password"
-)
+	o := &volumeOptions{
+		Server: volCtx["server"],
+		Share:  volCtx["share"],
+		Subdir: volCtx["subdir"],
+	}
+
+	if o.Server == "" {
+		return nil, fmt.Errorf("missing server in volume context of volume %s", volId)
+	}
+	if o.Share == "" {
+		o.Share = string(volId)
+	}
 
-type credentials struct {
-	username string
-	password string
+	return o, nil
 }
 
-func getCredentials(u, p string, secrets map[string]string) (*credentials, error) {
-	var (
-		c  = &credentials{}
-		ok bool
-	)
+// cifsSource returns the UNC path of subdir in share exported by server.
+func cifsSource(server, share, subdir string) string {
+	source := fmt.Sprintf("//%s/%s", server, share)
+	if subdir != "" {
+		source += "/" + strings.Trim(subdir, "/")
+	}
+
+	return source
+}
+
+// mountCifs mounts source to targetPath authenticating as cr. If cr is nil,
+// options have to select an authentication which needs no credentials, such
+// as sec=krb5. The mount is killed when ctx is done or mount times out.
+func mountCifs(ctx context.Context, mounter mount.Interface, source, targetPath string, cr *credentials, options []string) error {
+	mo := append([]string{}, options...)
 
-	if c.username, ok = secrets[u]; !ok {
-		return nil, fmt.Errorf("missing username in secrets")
+	if cr != nil {
+		credFile, err := writeCredentialsFile(cr)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		// mount.cifs reads the credentials only while mounting
+		defer os.Remove(credFile)
+
+		mo = append(mo, fmt.Sprintf("credentials=%s", credFile))
 	}
 
-	if c.password, ok = secrets[p]; !ok {
-		return nil, fmt.Errorf("missing password in secrets")
+	// The mounter of the host runs mount without a timeout, which hangs on
+	// unreachable servers, so mount is run by a commander instead
+	if _, ok := mounter.(*mount.Mounter); ok {
+		args := []string{"-t", "cifs"}
+		if len(mo) > 0 {
+			args = append(args, "-o", strings.Join(mo, ","))
+		}
+		args = append(args, source, targetPath)
+
+		c := &commander{cmd: "mount", options: args}
+		if out, err := c.execCommand(ctx); err != nil {
+			return classifyCommandError("mount", err, out)
+		}
+
+		return nil
 	}
 
-	return c, nil
-}
+	if err := mounter.Mount(source, targetPath, "cifs", mo); err != nil {
+		return cifsStatusError(codes.Internal, redactSecrets(err.Error()))
+	}
 
-func getUserCredentials(secrets map[string]string) (*credentials, error) {
-	return getCredentials(username, password, secrets)
+	return nil
 }
 
-func getAdminCredentials(secrets map[string]string) (*credentials, error) {
-	return getCredentials(admin_name, admin_password, secrets)
+// mountKerberos obtains a ticket for the volume volId with the Kerberos
+// credentials in secrets and mounts source to targetPath with it. The
+// ticket is stored in the credential cache of the cruid of the volume,
+// and renewed until the volume is unstaged.
+func (ns *nodeServer) mountKerberos(ctx context.Context, volId volumeID, source, targetPath string, secrets map[string]string, options []string) error {
+	kc, err := getKerberosCredentials(secrets)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to get Kerberos credentials from node stage secrets: %v", err)
+	}
+
+	t, err := ns.tickets.obtain(ctx, volId, kc)
+	if err != nil {
+		return statusError(codes.Internal, err)
+	}
+
+	mo := append([]string{}, options...)
+	mo = append(mo, fmt.Sprintf("cruid=%d", t.UID))
+
+	if err = mountCifs(ctx, ns.mounter, source, targetPath, nil, mo); err != nil {
+		ns.tickets.release(volId)
+		return err
+	}
+
+	return nil
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
@@ -137,36 +256,125 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if ns.mounter == nil {
-		ns.mounter = mount.New("")
+	release, err := ns.locks.acquire(volumeLock(volumeID(req.GetVolumeId())))
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
 	targetPath := req.GetTargetPath()
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+		glog.Infof("cifs: target path %s of volume %s does not exist", targetPath, req.GetVolumeId())
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
 
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+	// UnmountPath removes targetPath even if it's not mounted
+	if err := util.UnmountPath(targetPath, ns.mounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+
+	glog.Infof("cifs: successfully unmounted volume %s from %s", req.GetVolumeId(), targetPath)
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if err := validateNodeUnstageVolumeRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	err = util.UnmountPath(req.GetTargetPath(), mount.New(""))
+	release, err := ns.locks.acquire(volumeLock(volumeID(req.GetVolumeId())))
 	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stagingTargetPath := req.GetStagingTargetPath()
+	if _, err := os.Stat(stagingTargetPath); os.IsNotExist(err) {
+		// The ticket may outlive the staging path, e.g. after a retried call
+		ns.tickets.release(volumeID(req.GetVolumeId()))
+		glog.Infof("cifs: staging path %s of volume %s does not exist", stagingTargetPath, req.GetVolumeId())
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	// UnmountPath removes stagingTargetPath even if it's not mounted.
+	// The ticket is kept if it fails since the volume is still mounted,
+	// and released by the retried call.
+	if err := util.UnmountPath(stagingTargetPath, ns.mounter); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	ns.tickets.release(volumeID(req.GetVolumeId()))
+
+	glog.Infof("cifs: successfully unmounted volume %s from %s", req.GetVolumeId(), stagingTargetPath)
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(
-	ctx context.Context,
-	req *csi.NodeUnstageVolumeRequest) (
-	*csi.NodeUnstageVolumeResponse, error) {
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if err := validateNodeGetVolumeStatsRequest(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
+	volId := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+
+	available, capacity, usage, inodes, inodesFree, inodesUsed, err := fs.FsInfo(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s of volume %s does not exist", volumePath, volId)
+		}
+		// CSI v1.1 has no volume condition to report abnormal volumes with,
+		// so stale mounts fail the call instead of reporting bogus usage.
+		if isStaleMount(err) {
+			glog.Warningf("cifs: volume %s is abnormal, mount %s is stale: %v", volId, volumePath, err)
+			return nil, status.Errorf(codes.Unavailable, "volume %s is abnormal, mount %s is stale: %v", volId, volumePath, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get stats of volume %s at %s: %v", volId, volumePath, err)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: available,
+				Total:     capacity,
+				Used:      usage,
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: inodesFree,
+				Total:     inodes,
+				Used:      inodesUsed,
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		},
+	}, nil
+}
+
+// isStaleMount reports whether err was returned by a CIFS mount whose
+// server went away or whose handles are no longer valid.
+func isStaleMount(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	switch err {
+	case syscall.ESTALE, syscall.EHOSTDOWN, syscall.ENOTCONN:
+		return true
+	}
+
+	return false
+}
+
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
+
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: ns.caps,
+	}, nil
+}
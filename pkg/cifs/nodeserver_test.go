@@ -2,14 +2,25 @@ package cifs
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-test/utils"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
+var testVolumeCapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{},
+	},
+	AccessMode: &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	},
+}
+
 func TestNodePublishVolume(t *testing.T) {
 	// Setup simple driver
 	d := NewCifsDriver()
@@ -27,41 +38,91 @@ func TestNodePublishVolume(t *testing.T) {
 	defer conn.Close()
 
 	tests := []struct {
-		name   string
-		req    *csi.NodePublishVolumeRequest
-		errors bool
+		name     string
+		req      *csi.NodePublishVolumeRequest
+		errors   bool
+		readOnly bool
 	}{
 		{
 			name: "Success",
 			req: &csi.NodePublishVolumeRequest{
-				VolumeId:           "testvol",
-				StagingTargetPath:  "/tmp/stg",
-				TargetPath:         "/tmp/tgt",
-				Readonly:           false,
-				NodePublishSecrets: map[string]string{"username": "user", "password": "pass"},
-				VolumeAttributes:   map[string]string{"server": "example.com", "share": "test"},
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				TargetPath:        "/tmp/tgt",
+				Readonly:          false,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
 			},
 			errors: false,
 		},
+		{
+			name: "Success as readonly",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				TargetPath:        "/tmp/tgt",
+				Readonly:          true,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors:   false,
+			readOnly: true,
+		},
+		{
+			name: "Success as readonly due to access mode",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
+				TargetPath:    "/tmp/tgt",
+				Readonly:      false,
+				Secrets:       map[string]string{"username": "user", "password": "pass"},
+				VolumeContext: map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors:   false,
+			readOnly: true,
+		},
 		{
 			name: "Fail due to missing volume ID",
 			req: &csi.NodePublishVolumeRequest{
-				StagingTargetPath:  "/tmp/stg",
-				TargetPath:         "/tmp/tgt",
-				Readonly:           false,
-				NodePublishSecrets: map[string]string{"username": "user", "password": "pass"},
-				VolumeAttributes:   map[string]string{"server": "example.com", "share": "test"},
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				TargetPath:        "/tmp/tgt",
+				Readonly:          false,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to missing staging target path",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:      "testvol",
+				TargetPath:    "/tmp/tgt",
+				Readonly:      false,
+				Secrets:       map[string]string{"username": "user", "password": "pass"},
+				VolumeContext: map[string]string{"server": "example.com", "share": "test"},
 			},
 			errors: true,
 		},
 		{
 			name: "Fail due to missing target path",
 			req: &csi.NodePublishVolumeRequest{
-				VolumeId:           "testvol",
-				StagingTargetPath:  "/tmp/stg",
-				Readonly:           false,
-				NodePublishSecrets: map[string]string{"username": "user", "password": "pass"},
-				VolumeAttributes:   map[string]string{"server": "example.com", "share": "test"},
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Readonly:          false,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
 			},
 			errors: true,
 		},
@@ -78,16 +139,147 @@ func TestNodePublishVolume(t *testing.T) {
 		if err == nil && tc.errors {
 			t.Errorf("%s: expected error, but not got any error", tc.name)
 		}
+		if err == nil && isReadOnlyMount(d.ns.mounter.(*mount.FakeMounter), tc.req.TargetPath) != tc.readOnly {
+			t.Errorf("%s: expected readonly mount as %v, but got %v", tc.name, tc.readOnly, !tc.readOnly)
+		}
 		d.ns.mounter.Unmount(tc.req.TargetPath)
 	}
 }
 
-func TestNodeUnpublishVolume(t *testing.T) {
+func TestNodeStageVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-krb5-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
 	// Setup simple driver
 	d := NewCifsDriver()
 	d.Init(driverName, nodeId)
 
-	mp := mount.MountPoint{Device: "/dev/foo", Path: "/tmp/tgt"}
+	d.ns.mounter = &mount.FakeMounter{}
+	d.ns.tickets = newKerberosTickets(dir, &fakeCommander{})
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name   string
+		req    *csi.NodeStageVolumeRequest
+		errors bool
+	}{
+		{
+			name: "Success",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to missing staging target path",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:      "testvol",
+				Secrets:       map[string]string{"username": "user", "password": "pass"},
+				VolumeContext: map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors: true,
+		},
+		{
+			name: "Success with versioned volume ID",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "csi-cifs-v1#net#example.com#csi-cifs-testvol####",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to missing server",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to missing volume capability",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				Secrets:           map[string]string{"username": "user", "password": "pass"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to missing password",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"username": "user"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test"},
+			},
+			errors: true,
+		},
+		{
+			name: "Success with Kerberos credential cache",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"krb5cc": "Q0NBQ0hF"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test", "sec": "krb5"},
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to missing Kerberos credentials",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+				VolumeCapability:  testVolumeCapability,
+				Secrets:           map[string]string{"username": "user"},
+				VolumeContext:     map[string]string{"server": "example.com", "share": "test", "sec": "krb5"},
+			},
+			errors: true,
+		},
+	}
+
+	// Make a call
+	c := csi.NewNodeClient(conn)
+
+	for _, tc := range tests {
+		_, err = c.NodeStageVolume(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		d.ns.mounter.Unmount(tc.req.StagingTargetPath)
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+
+	mp := mount.MountPoint{Device: "//example.com/test", Path: "/tmp/stg"}
 	d.ns.mounter = &mount.FakeMounter{MountPoints: []mount.MountPoint{mp}}
 	go d.Start(tcp_ep)
 	defer d.Stop()
@@ -101,8 +293,80 @@ func TestNodeUnpublishVolume(t *testing.T) {
 
 	tests := []struct {
 		name   string
-		req    *csi.NodeUnpublishVolumeRequest
+		req    *csi.NodeUnstageVolumeRequest
 		errors bool
+	}{
+		{
+			name: "Success",
+			req: &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "testvol",
+				StagingTargetPath: "/tmp/stg",
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to missing staging target path",
+			req: &csi.NodeUnstageVolumeRequest{
+				VolumeId: "testvol",
+			},
+			errors: true,
+		},
+	}
+
+	// Make a call
+	c := csi.NewNodeClient(conn)
+
+	for _, tc := range tests {
+		if tc.req.StagingTargetPath != "" {
+			os.MkdirAll(tc.req.StagingTargetPath, 0750)
+		}
+		_, err = c.NodeUnstageVolume(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+
+	// The ticket is released even if the staging path is already gone
+	d.ns.tickets.mtx.Lock()
+	d.ns.tickets.tickets["krb5vol"] = &kerberosTicket{VolumeID: "krb5vol", UID: kerberosUID("krb5vol")}
+	d.ns.tickets.mtx.Unlock()
+
+	if _, err = c.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "krb5vol", StagingTargetPath: "/tmp/stg-missing"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	d.ns.tickets.mtx.Lock()
+	if _, ok := d.ns.tickets.tickets["krb5vol"]; ok {
+		t.Errorf("expected the ticket of volume krb5vol to be released")
+	}
+	d.ns.tickets.mtx.Unlock()
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+
+	mp := mount.MountPoint{Device: "/dev/foo", Path: "/tmp/tgt"}
+	d.ns.mounter = &mount.FakeMounter{MountPoints: []mount.MountPoint{mp}}
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		req      *csi.NodeUnpublishVolumeRequest
+		noTarget bool
+		errors   bool
 	}{
 		{
 			name: "Success",
@@ -113,12 +377,29 @@ func TestNodeUnpublishVolume(t *testing.T) {
 			errors: false,
 		},
 		{
-			name: "Fail due to not mounted targetpath",
+			name: "Success with not mounted targetpath",
 			req: &csi.NodeUnpublishVolumeRequest{
 				VolumeId:   "testvol",
 				TargetPath: "/tmp/wrong",
 			},
-			errors: true,
+			errors: false,
+		},
+		{
+			name: "Success with missing targetpath",
+			req: &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "testvol",
+				TargetPath: "/tmp/missing",
+			},
+			noTarget: true,
+			errors:   false,
+		},
+		{
+			name: "Fail due to missing target path",
+			req: &csi.NodeUnpublishVolumeRequest{
+				VolumeId: "testvol",
+			},
+			noTarget: true,
+			errors:   true,
 		},
 	}
 
@@ -126,7 +407,9 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	c := csi.NewNodeClient(conn)
 
 	for _, tc := range tests {
-		os.MkdirAll(tc.req.TargetPath, 0750)
+		if !tc.noTarget {
+			os.MkdirAll(tc.req.TargetPath, 0750)
+		}
 		_, err = c.NodeUnpublishVolume(context.Background(), tc.req)
 		if err != nil && !tc.errors {
 			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
@@ -137,3 +420,123 @@ func TestNodeUnpublishVolume(t *testing.T) {
 		d.ns.mounter.Unmount(tc.req.TargetPath)
 	}
 }
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	// Setup simple driver
+	d := NewCifsDriver()
+	d.Init(driverName, nodeId)
+
+	go d.Start(tcp_ep)
+	defer d.Stop()
+
+	// Setup a connection to the driver
+	conn, err := utils.Connect(tcp_addr)
+	if err != nil {
+		t.Errorf("Error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name   string
+		req    *csi.NodeGetVolumeStatsRequest
+		errors bool
+	}{
+		{
+			name: "Success",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "testvol",
+				VolumePath: os.TempDir(),
+			},
+			errors: false,
+		},
+		{
+			name: "Fail due to missing volume ID",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumePath: os.TempDir(),
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to missing volume path",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumeId: "testvol",
+			},
+			errors: true,
+		},
+		{
+			name: "Fail due to nonexistent volume path",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "testvol",
+				VolumePath: "/tmp/csi-cifs-nonexistent",
+			},
+			errors: true,
+		},
+	}
+
+	// Make a call
+	c := csi.NewNodeClient(conn)
+
+	for _, tc := range tests {
+		res, err := c.NodeGetVolumeStats(context.Background(), tc.req)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && len(res.GetUsage()) != 2 {
+			t.Errorf("%s: expected bytes and inodes usage, but got %v", tc.name, res.GetUsage())
+		}
+	}
+}
+
+func TestIsStaleMount(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{err: syscall.ESTALE, exp: true},
+		{err: &os.PathError{Op: "statfs", Path: "/tmp/tgt", Err: syscall.EHOSTDOWN}, exp: true},
+		{err: &os.PathError{Op: "statfs", Path: "/tmp/tgt", Err: syscall.ENOTCONN}, exp: true},
+		{err: syscall.ENOENT, exp: false},
+		{err: &os.PathError{Op: "statfs", Path: "/tmp/tgt", Err: syscall.EACCES}, exp: false},
+	}
+
+	for _, tc := range tests {
+		if stale := isStaleMount(tc.err); stale != tc.exp {
+			t.Errorf("%v: expected stale as %v, but got %v", tc.err, tc.exp, stale)
+		}
+	}
+}
+
+func TestCifsSource(t *testing.T) {
+	tests := []struct {
+		server, share, subdir string
+		exp                   string
+	}{
+		{server: "example.com", share: "test", exp: "//example.com/test"},
+		{server: "example.com", share: "test", subdir: "vols/testvol", exp: "//example.com/test/vols/testvol"},
+		{server: "example.com", share: "test", subdir: "/testvol/", exp: "//example.com/test/testvol"},
+	}
+
+	for _, tc := range tests {
+		if s := cifsSource(tc.server, tc.share, tc.subdir); s != tc.exp {
+			t.Errorf("expected %s, but got %s", tc.exp, s)
+		}
+	}
+}
+
+func isReadOnlyMount(m *mount.FakeMounter, target string) bool {
+	for _, mp := range m.MountPoints {
+		if mp.Path != target {
+			continue
+		}
+		for _, opt := range mp.Opts {
+			if opt == "ro" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package cifs
+
+import (
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationLocks serializes the operations on the same volumes and snapshots.
+// Operations don't wait for each other: an operation conflicting with one in
+// flight fails with Aborted, and the CO retries it later.
+type operationLocks struct {
+	mtx   sync.Mutex
+	locks map[string]bool
+}
+
+func newOperationLocks() *operationLocks {
+	return &operationLocks{locks: make(map[string]bool)}
+}
+
+// acquire locks all the keys, or none of them if any is already locked,
+// and returns a function releasing them.
+func (l *operationLocks) acquire(keys ...string) (func(), error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var busy []string
+	for _, key := range keys {
+		if l.locks[key] {
+			busy = append(busy, key)
+		}
+	}
+	if len(busy) > 0 {
+		return nil, status.Errorf(codes.Aborted, "an operation on %s is already in progress", strings.Join(busy, ", "))
+	}
+
+	for _, key := range keys {
+		l.locks[key] = true
+	}
+
+	return func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+
+		for _, key := range keys {
+			delete(l.locks, key)
+		}
+	}, nil
+}
+
+func volumeLock(volId volumeID) string {
+	return "volume " + string(volId)
+}
+
+func volumeNameLock(name string) string {
+	return "volume name " + name
+}
+
+func snapshotLock(snapId snapshotID) string {
+	return "snapshot " + string(snapId)
+}
+
+func snapshotNameLock(name string) string {
+	return "snapshot name " + name
+}
+
+// shareLock locks the share name on server, which the orphaned share
+// reconciler takes as the volume of an orphaned share may be unknown.
+func shareLock(server, name string) string {
+	return "share " + server + "/" + name
+}
@@ -0,0 +1,52 @@
+package cifs
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLocks(t *testing.T) {
+	l := newOperationLocks()
+
+	release, err := l.acquire("a", "b")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		code codes.Code
+	}{
+		{name: "Fail due to locked key", keys: []string{"a"}, code: codes.Aborted},
+		{name: "Fail due to one locked key", keys: []string{"c", "b"}, code: codes.Aborted},
+		{name: "Success with unlocked key", keys: []string{"d"}, code: codes.OK},
+	}
+
+	for _, tc := range tests {
+		r, err := l.acquire(tc.keys...)
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, err)
+		}
+		if err == nil {
+			r()
+		}
+	}
+
+	// Failed acquisitions don't lock any key
+	if r, err := l.acquire("c"); err != nil {
+		t.Errorf("expected c not to be locked, but got %v", err)
+	} else {
+		r()
+	}
+
+	release()
+
+	if r, err := l.acquire("a", "b"); err != nil {
+		t.Errorf("expected released keys to be unlocked, but got %v", err)
+	} else {
+		r()
+	}
+}
@@ -0,0 +1,263 @@
+package cifs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// orphanReconciler looks for the shares created by the driver which no
+// volume refers to anymore, such as shares left behind by a CreateVolume
+// which failed after creating the share or by a partially failed
+// DeleteVolume. The shares under the paths of the volumes in the controller
+// cache are compared with the cache and, optionally, with the
+// PersistentVolumes of the driver. Orphaned shares are reported once
+// they have been orphaned for the grace period, which covers CreateVolume
+// calls in flight, and removed if enabled.
+type orphanReconciler struct {
+	cs          *controllerServer
+	interval    time.Duration
+	gracePeriod time.Duration
+	// remove is only honored with listPVs, since the controller cache alone
+	// may miss volumes, e.g. after the controller moved to another node
+	remove bool
+
+	// listPVs returns the volume IDs of the PersistentVolumes of the driver, if not nil
+	listPVs func() ([]volumeID, error)
+
+	// orphans records when each orphaned share was first seen
+	orphans map[orphanKey]time.Time
+}
+
+type orphanKey struct {
+	shareListKey
+	name string
+}
+
+func newOrphanReconciler(cs *controllerServer, interval, gracePeriod time.Duration, remove bool, listPVs func() ([]volumeID, error)) *orphanReconciler {
+	return &orphanReconciler{
+		cs:          cs,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		remove:      remove,
+		listPVs:     listPVs,
+		orphans:     make(map[orphanKey]time.Time),
+	}
+}
+
+// run reconciles every interval until stopCh is closed.
+func (r *orphanReconciler) run(stopCh <-chan struct{}) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+			if err := r.reconcile(time.Now()); err != nil {
+				glog.Errorf("cifs: failed to look for orphaned shares: %v", err)
+			}
+		}
+	}
+}
+
+// reconcile lists the shares of the known servers and reports or removes
+// the ones which have been orphaned for the grace period at now.
+func (r *orphanReconciler) reconcile(now time.Time) error {
+	cr, err := r.cs.getAdminSecretsDirCredentials()
+	if err != nil {
+		return err
+	}
+
+	servers := make(map[shareListKey]volumeOptions)
+	known := make(map[shareListKey]map[string]bool)
+
+	addVolume := func(o *volumeOptions) {
+		key := newOrphanListKey(o)
+		if _, ok := servers[key]; !ok {
+			known[key] = make(map[string]bool)
+		}
+		// Prefer options whose path doesn't need to be resolved
+		if cur, ok := servers[key]; !ok || (cur.Path == "" && o.Path != "") {
+			servers[key] = *o
+		}
+		known[key][o.shareName()] = true
+	}
+
+	for _, ent := range ctrCache.list() {
+		addVolume(&ent.VolOptions)
+	}
+
+	if r.listPVs != nil {
+		// Nothing is reported if the PersistentVolumes are unknown
+		volIds, err := r.listPVs()
+		if err != nil {
+			return fmt.Errorf("failed to list PersistentVolumes: %v", err)
+		}
+
+		for _, volId := range volIds {
+			o, err := getVolumeOptions(volId)
+			if err != nil {
+				glog.Warningf("cifs: skipping PersistentVolume with volume ID %s: %v", volId, err)
+				continue
+			}
+			addVolume(o)
+		}
+	}
+
+	seen := make(map[orphanKey]bool)
+	listed := make(map[shareListKey]bool)
+
+	for key, o := range servers {
+		if o.Path == "" && o.PathHash == "" {
+			// The shares of other drivers can't be told apart
+			glog.Warningf("cifs: not looking for orphaned shares on %s of volumes without path", o.Server)
+			continue
+		}
+
+		// The path of volumes only known from their volume ID is resolved
+		// from the share of the volume
+		sm, err := r.cs.newVolumeShareManager(context.Background(), &o, cr)
+		if err != nil {
+			glog.Errorf("cifs: failed to look for orphaned shares on %s: %v", o.Server, err)
+			continue
+		}
+
+		names, err := sm.listShares()
+		if err != nil {
+			glog.Errorf("cifs: failed to list shares on %s: %v", o.Server, err)
+			continue
+		}
+		listed[key] = true
+
+		for _, name := range names {
+			if !strings.HasPrefix(name, volumeIDPrefix) || known[key][name] {
+				continue
+			}
+
+			s, err := sm.getShare(name)
+			if err != nil {
+				if err != errShareNotFound {
+					glog.Errorf("cifs: failed to get share %s on %s: %v", name, o.Server, err)
+				}
+				continue
+			}
+			if !isSharePathWithin(s.Path, o.Path) {
+				continue
+			}
+
+			k := orphanKey{shareListKey: key, name: name}
+			seen[k] = true
+
+			first, ok := r.orphans[k]
+			if !ok {
+				r.orphans[k] = now
+				first = now
+			}
+			if now.Sub(first) < r.gracePeriod {
+				continue
+			}
+
+			if !r.remove || r.listPVs == nil {
+				glog.Warningf("cifs: share %s on %s is orphaned since %v", name, o.Server, first)
+				continue
+			}
+
+			if err = r.removeShare(sm, o, s); err != nil {
+				glog.Errorf("cifs: failed to remove orphaned share %s on %s: %v", name, o.Server, err)
+				continue
+			}
+			glog.Infof("cifs: removed share %s on %s, orphaned since %v", name, o.Server, first)
+			delete(r.orphans, k)
+		}
+	}
+
+	// Forget the shares which are gone or aren't orphaned anymore
+	for k := range r.orphans {
+		if _, ok := servers[k.shareListKey]; !ok || (listed[k.shareListKey] && !seen[k]) {
+			delete(r.orphans, k)
+		}
+	}
+
+	return nil
+}
+
+// removeShare deletes the orphaned share s listed from the volume options o,
+// unless a volume operation on it is in flight or it belongs to a volume
+// by now.
+func (r *orphanReconciler) removeShare(sm shareManager, o volumeOptions, s *shareInfo) error {
+	o.assignShare(s.Name)
+
+	locks := []string{volumeLock(newVolumeID(&o)), shareLock(o.Server, s.Name)}
+	if s.Comment != "" {
+		// net shares are commented with the volume name
+		locks = append(locks, volumeNameLock(s.Comment))
+	}
+
+	release, err := r.cs.locks.acquire(locks...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, ent := range ctrCache.list() {
+		if newOrphanListKey(&ent.VolOptions) == newOrphanListKey(&o) && ent.VolOptions.shareName() == s.Name {
+			return fmt.Errorf("share belongs to volume %s", ent.VolumeID)
+		}
+	}
+
+	if err = sm.deleteShare(s.Name); err != nil && err != errShareNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// newOrphanListKey returns the key of the shares listed for the volume
+// options o. Unlike for newShareListKey, the path is always part of the
+// key since only the shares under the path are looked at. The path of net
+// volumes is only known by its hash from their volume ID.
+func newOrphanListKey(o *volumeOptions) shareListKey {
+	key := newShareListKey(o)
+	if o.ShareManager != subdirShareManagerName {
+		key.path = o.pathHash()
+	}
+
+	return key
+}
+
+// isSharePathWithin reports whether the share path p, as reported by the
+// server, is dir or lies under it.
+func isSharePathWithin(p, dir string) bool {
+	p = cleanSharePath(p)
+	dir = path.Clean("/" + dir)
+
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// newPVLister returns a function listing the volume IDs of the
+// PersistentVolumes provisioned by the driver named driverName.
+func newPVLister(client kubernetes.Interface, driverName string) func() ([]volumeID, error) {
+	return func() ([]volumeID, error) {
+		pvs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		var volIds []volumeID
+		for _, pv := range pvs.Items {
+			if csi := pv.Spec.CSI; csi != nil && csi.Driver == driverName {
+				volIds = append(volIds, volumeID(csi.VolumeHandle))
+			}
+		}
+
+		return volIds, nil
+	}
+}
@@ -0,0 +1,159 @@
+package cifs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// listCommander returns the same output for every command.
+type listCommander struct {
+	fakeCommander
+	out []byte
+}
+
+func (c *listCommander) execCommand(ctx context.Context) ([]byte, error) {
+	return c.out, nil
+}
+
+func TestOrphanReconciler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-secrets-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{"admin_name": "user", "admin_password": "pass"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+
+	cs := &controllerServer{
+		// The same output serves as share list and share info
+		commander:       &listCommander{out: []byte("csi-cifs-orphan\ncsi-cifs-known\nIPC$\npath: C:\\srv\\shares\\csi-cifs-known\nremark: pvc-1\n")},
+		adminSecretsDir: dir,
+		locks:           newOperationLocks(),
+	}
+
+	volOptions := &volumeOptions{ShareManager: "net", Server: "192.168.122.10", Path: "/srv/shares", Share: "csi-cifs-known"}
+
+	tests := []struct {
+		name     string
+		path     string
+		remove   bool
+		checkPVs bool
+		cached   bool
+		locks    []string
+		orphan   bool
+		exp      bool
+	}{
+		{name: "Report orphaned share", path: "/srv/shares", remove: false, checkPVs: true, orphan: true, exp: true},
+		{name: "Remove orphaned share", path: "/srv/shares", remove: true, checkPVs: true, orphan: true, exp: false},
+		{name: "Keep orphaned share without PersistentVolumes", path: "/srv/shares", remove: true, cached: true, orphan: true, exp: true},
+		{name: "Keep orphaned share in use", path: "/srv/shares", remove: true, checkPVs: true, locks: []string{volumeNameLock("pvc-1")}, orphan: true, exp: true},
+		{name: "Ignore share outside of path", path: "/srv/other", remove: true, checkPVs: true, cached: true},
+	}
+
+	for _, tc := range tests {
+		o := *volOptions
+		o.Path = tc.path
+		known := orphanKey{shareListKey: newOrphanListKey(&o), name: "csi-cifs-known"}
+		orphan := orphanKey{shareListKey: newOrphanListKey(&o), name: "csi-cifs-orphan"}
+		other := orphanKey{shareListKey: newOrphanListKey(&o), name: "IPC$"}
+
+		volId := newVolumeID(&o)
+
+		var listPVs func() ([]volumeID, error)
+		if tc.checkPVs {
+			listPVs = func() ([]volumeID, error) {
+				return []volumeID{volId}, nil
+			}
+		}
+		if tc.cached {
+			if err = ctrCache.insert(&controllerCacheEntry{VolOptions: o, VolumeID: volId}); err != nil {
+				t.Fatalf("%s: failed to insert cache entry: %v", tc.name, err)
+			}
+		}
+
+		r := newOrphanReconciler(cs, time.Minute, time.Hour, tc.remove, listPVs)
+		now := time.Now()
+
+		err = r.reconcile(now)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if _, ok := r.orphans[orphan]; ok != tc.orphan {
+			t.Errorf("%s: expected share %s to be orphaned: %v, but got %v", tc.name, orphan.name, tc.orphan, ok)
+		}
+		if _, ok := r.orphans[known]; ok {
+			t.Errorf("%s: expected share %s not to be orphaned", tc.name, known.name)
+		}
+		if _, ok := r.orphans[other]; ok {
+			t.Errorf("%s: expected share %s to be ignored", tc.name, other.name)
+		}
+
+		release, err := cs.locks.acquire(tc.locks...)
+		if err != nil {
+			t.Fatalf("%s: failed to acquire locks: %v", tc.name, err)
+		}
+
+		// The orphaned share is only removed after the grace period
+		if err = r.reconcile(now.Add(time.Hour)); err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		} else if _, ok := r.orphans[orphan]; ok != tc.exp {
+			t.Errorf("%s: expected share %s to be tracked: %v, but got %v", tc.name, orphan.name, tc.exp, ok)
+		}
+
+		release()
+		if tc.cached {
+			ctrCache.pop(volId)
+		}
+	}
+
+	listPVs := func() ([]volumeID, error) {
+		return []volumeID{newVolumeID(volOptions)}, nil
+	}
+
+	// Nothing is reported if the PersistentVolumes can't be listed
+	r := newOrphanReconciler(cs, time.Minute, time.Hour, true, func() ([]volumeID, error) {
+		return nil, errors.New("forbidden")
+	})
+	if err = r.reconcile(time.Now()); err == nil {
+		t.Errorf("expected error for failed PersistentVolume listing, but not got any error")
+	}
+
+	// Nor without admin credentials
+	cs.adminSecretsDir = ""
+	r = newOrphanReconciler(cs, time.Minute, time.Hour, true, listPVs)
+	if err = r.reconcile(time.Now()); err == nil {
+		t.Errorf("expected error for missing admin secrets, but not got any error")
+	}
+}
+
+func TestIsSharePathWithin(t *testing.T) {
+	tests := []struct {
+		path string
+		dir  string
+		exp  bool
+	}{
+		{"/srv/shares", "/srv/shares", true},
+		{"/srv/shares/csi-cifs-1", "/srv/shares/", true},
+		{"C:\\srv\\shares\\csi-cifs-1", "/srv/shares", true},
+		{"/srv/shares/../other", "/srv/shares", false},
+		{"/srv/shares2", "/srv/shares", false},
+		{"/srv", "/srv/shares", false},
+		{"/srv/shares", "/", true},
+	}
+
+	for _, tc := range tests {
+		if ok := isSharePathWithin(tc.path, tc.dir); ok != tc.exp {
+			t.Errorf("%s within %s: expected %v, but got %v", tc.path, tc.dir, tc.exp, ok)
+		}
+	}
+}
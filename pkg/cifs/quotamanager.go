@@ -0,0 +1,299 @@
+package cifs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	noQuotaManagerName    = "none"
+	xfsQuotaManagerName   = "xfs"
+	dfreeQuotaManagerName = "dfree"
+
+	defaultDfreeCommand = "/usr/local/bin/csi-cifs-dfree"
+)
+
+// quotaManager limits the size of the shares created by a share manager.
+type quotaManager interface {
+	setQuota(name string, bytes int64) error
+	removeQuota(name string) error
+}
+
+type quotaManagerFactory func(ctx context.Context, volOptions *volumeOptions, sm shareManager, c Interface) quotaManager
+
+var quotaManagers = map[string]quotaManagerFactory{
+	noQuotaManagerName:    newNoQuotaManager,
+	xfsQuotaManagerName:   newXfsQuotaManager,
+	dfreeQuotaManagerName: newDfreeQuotaManager,
+}
+
+// newQuotaManager returns the quota manager selected by volOptions for the shares managed by sm.
+// The commands issued by the quota manager are canceled when ctx is done.
+// If c is not nil, it is used to run all the commands issued by the quota manager.
+func newQuotaManager(ctx context.Context, volOptions *volumeOptions, sm shareManager, c Interface) (quotaManager, error) {
+	name := volOptions.QuotaManager
+	if name == "" {
+		name = noQuotaManagerName
+	}
+
+	f, ok := quotaManagers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown quota manager %q, supported quota managers are %v", name, quotaManagerNames())
+	}
+
+	return f(ctx, volOptions, sm, c), nil
+}
+
+func quotaManagerNames() []string {
+	names := make([]string, 0, len(quotaManagers))
+	for name := range quotaManagers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// noQuotaManager doesn't limit the size of shares.
+type noQuotaManager struct{}
+
+var _ quotaManager = &noQuotaManager{}
+
+func newNoQuotaManager(ctx context.Context, volOptions *volumeOptions, sm shareManager, c Interface) quotaManager {
+	return &noQuotaManager{}
+}
+
+func (m *noQuotaManager) setQuota(name string, bytes int64) error {
+	return nil
+}
+
+func (m *noQuotaManager) removeQuota(name string) error {
+	return nil
+}
+
+// xfsQuotaManager limits the size of shares with XFS project quotas on
+// their directories, so it has the requirements of netShareManager.
+type xfsQuotaManager struct {
+	ctx       context.Context
+	dir       string
+	commander Interface
+}
+
+var _ quotaManager = &xfsQuotaManager{}
+
+func newXfsQuotaManager(ctx context.Context, volOptions *volumeOptions, sm shareManager, c Interface) quotaManager {
+	return &xfsQuotaManager{ctx: ctx, dir: volOptions.Path, commander: c}
+}
+
+func (m *xfsQuotaManager) run(mountPoint, cmd string) ([]byte, error) {
+	args := []string{"-x", "-c", cmd, mountPoint}
+
+	c := m.commander
+	if c == nil {
+		c = &commander{cmd: "xfs_quota", options: args}
+	}
+
+	out, err := c.execCommand(m.ctx)
+	if err != nil {
+		return nil, commandError("xfs_quota", err, out)
+	}
+
+	return out, nil
+}
+
+// projectID returns the XFS project ID of the directory dir.
+func (m *xfsQuotaManager) projectID(dir string) (uint32, error) {
+	c := m.commander
+	if c == nil {
+		c = &commander{cmd: "xfs_io", options: []string{"-r", "-c", "lsproj", dir}}
+	}
+
+	// $ xfs_io -r -c lsproj DIR
+	// projid = ID
+	out, err := c.execCommand(m.ctx)
+	if err != nil {
+		return 0, commandError("xfs_io", err, out)
+	}
+
+	var id uint32
+	if _, err = fmt.Sscanf(strings.TrimSpace(string(out)), "projid = %d", &id); err != nil {
+		return 0, fmt.Errorf("failed to parse the project ID of %s from %q: %v", dir, out, err)
+	}
+
+	return id, nil
+}
+
+// isProjectUsed reports whether files on the filesystem mounted at mountPoint
+// are accounted to the XFS project id.
+func (m *xfsQuotaManager) isProjectUsed(mountPoint string, id uint32) (bool, error) {
+	// $ xfs_quota -x -c 'report -p -i -N -n' MOUNT_POINT
+	// #ID USED SOFT HARD WARN/GRACE
+	out, err := m.run(mountPoint, "report -p -i -N -n")
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "#"+strconv.FormatUint(uint64(id), 10) {
+			return fields[1] != "0", nil
+		}
+	}
+
+	return false, nil
+}
+
+// xfsQuoteArg quotes arg for the command line of xfs_quota, which is split
+// at blanks outside of double quotes.
+func xfsQuoteArg(arg string) (string, error) {
+	if strings.ContainsAny(arg, "\"\n") {
+		return "", fmt.Errorf("%q can't be passed to xfs_quota", arg)
+	}
+
+	return `"` + arg + `"`, nil
+}
+
+func (m *xfsQuotaManager) setQuota(name string, bytes int64) error {
+	if m.dir == "" {
+		return fmt.Errorf("the directory of share %s is unknown, path is not set", name)
+	}
+
+	shareDir := filepath.Join(m.dir, name)
+
+	mountPoint, err := findMountPoint(shareDir)
+	if err != nil {
+		return fmt.Errorf("failed to find the filesystem of share %s: %v", name, err)
+	}
+
+	id := xfsProjectID(name)
+
+	cur, err := m.projectID(shareDir)
+	if err != nil {
+		return err
+	}
+
+	// The project is already set up if the quota is only changed
+	if cur != id {
+		// Project IDs are hashes of the share names, so another share may
+		// already use the project
+		used, err := m.isProjectUsed(mountPoint, id)
+		if err != nil {
+			return err
+		}
+		if used {
+			return fmt.Errorf("project ID %d of share %s is already used by another directory on %s", id, name, mountPoint)
+		}
+
+		quoted, err := xfsQuoteArg(shareDir)
+		if err != nil {
+			return err
+		}
+
+		// $ xfs_quota -x -c 'project -s -p "/PATH/TO/SHARE" ID' MOUNT_POINT
+		if _, err = m.run(mountPoint, fmt.Sprintf("project -s -p %s %d", quoted, id)); err != nil {
+			return err
+		}
+	}
+
+	// $ xfs_quota -x -c 'limit -p bhard=BYTES ID' MOUNT_POINT
+	_, err = m.run(mountPoint, fmt.Sprintf("limit -p bhard=%d %d", bytes, id))
+	return err
+}
+
+func (m *xfsQuotaManager) removeQuota(name string) error {
+	if m.dir == "" {
+		return fmt.Errorf("the directory of share %s is unknown, path is not set", name)
+	}
+
+	mountPoint, err := findMountPoint(m.dir)
+	if err != nil {
+		return fmt.Errorf("failed to find the filesystem of share %s: %v", name, err)
+	}
+
+	// $ xfs_quota -x -c 'limit -p bhard=0 ID' MOUNT_POINT
+	_, err = m.run(mountPoint, fmt.Sprintf("limit -p bhard=0 %d", xfsProjectID(name)))
+	return err
+}
+
+// xfsProjectID returns the XFS project ID of the share named name.
+// It is derived from the name so that the quota can be removed without any local state.
+func xfsProjectID(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	// Project 0 is the default project of all files
+	if id := h.Sum32(); id != 0 {
+		return id
+	}
+
+	return 1
+}
+
+// findMountPoint returns the mount point of the filesystem p resides upon.
+func findMountPoint(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+
+	for p != "/" {
+		parent := filepath.Dir(p)
+
+		fi, err = os.Stat(parent)
+		if err != nil {
+			return "", err
+		}
+		if fi.Sys().(*syscall.Stat_t).Dev != dev {
+			break
+		}
+
+		p = parent
+	}
+
+	return p, nil
+}
+
+// dfreeQuotaManager limits the size of shares reported to clients by
+// setting the `dfree command` of each share. The command is called by
+// Samba with the size in bytes and the directory being queried.
+// It requires registry shares, since it is set via `net rpc conf`.
+type dfreeQuotaManager struct {
+	command string
+	sm      shareManager
+}
+
+var _ quotaManager = &dfreeQuotaManager{}
+
+func newDfreeQuotaManager(ctx context.Context, volOptions *volumeOptions, sm shareManager, c Interface) quotaManager {
+	command := volOptions.DfreeCommand
+	if command == "" {
+		command = defaultDfreeCommand
+	}
+
+	return &dfreeQuotaManager{command: command, sm: sm}
+}
+
+func (m *dfreeQuotaManager) setQuota(name string, bytes int64) error {
+	return m.sm.setShareOptions(name, map[string]string{
+		"dfree command": m.command + " " + strconv.FormatInt(bytes, 10),
+	})
+}
+
+func (m *dfreeQuotaManager) removeQuota(name string) error {
+	// The dfree command is removed along with the share
+	return nil
+}
@@ -0,0 +1,199 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// optionsShareManager records the share options set by quota managers.
+type optionsShareManager struct {
+	netShareManager
+	opts map[string]map[string]string
+}
+
+func (m *optionsShareManager) setShareOptions(name string, opts map[string]string) error {
+	m.opts[name] = opts
+	return nil
+}
+
+func TestNewQuotaManager(t *testing.T) {
+	tests := []struct {
+		name   string
+		qm     string
+		errors bool
+	}{
+		{name: "Default", qm: "", errors: false},
+		{name: "none", qm: "none", errors: false},
+		{name: "xfs", qm: "xfs", errors: false},
+		{name: "dfree", qm: "dfree", errors: false},
+		{name: "Fail due to unknown quota manager", qm: "foo", errors: true},
+	}
+
+	for _, tc := range tests {
+		_, err := newQuotaManager(context.Background(), &volumeOptions{Server: "192.168.122.1", QuotaManager: tc.qm}, &netShareManager{}, &fakeCommander{})
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+}
+
+// seqCommander returns the outputs of successive commands in turn.
+type seqCommander struct {
+	fakeCommander
+	outs []string
+}
+
+func (c *seqCommander) execCommand(ctx context.Context) ([]byte, error) {
+	if len(c.outs) == 0 {
+		return nil, nil
+	}
+
+	out := c.outs[0]
+	c.outs = c.outs[1:]
+	return []byte(out), nil
+}
+
+func TestXfsQuotaManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-quota-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.Mkdir(filepath.Join(dir, "csi-cifs-testvol"), 0755); err != nil {
+		t.Fatalf("failed to create share directory: %v", err)
+	}
+
+	id := strconv.FormatUint(uint64(xfsProjectID("csi-cifs-testvol")), 10)
+
+	tests := []struct {
+		name   string
+		share  string
+		outs   []string
+		errors bool
+	}{
+		{name: "Success", share: "csi-cifs-testvol", outs: []string{"projid = 0\n", "#0 12 0 0 00 [--------]\n"}, errors: false},
+		{name: "Success with project already set", share: "csi-cifs-testvol", outs: []string{"projid = " + id + "\n"}, errors: false},
+		{name: "Fail due to project ID collision", share: "csi-cifs-testvol", outs: []string{"projid = 0\n", "#0 12 0 0 00 [--------]\n#" + id + " 3 0 0 00 [--------]\n"}, errors: true},
+		{name: "Fail due to unparsable project ID", share: "csi-cifs-testvol", outs: []string{""}, errors: true},
+		{name: "Fail due to nonexistent share", share: "csi-cifs-nonexistent", errors: true},
+	}
+
+	for _, tc := range tests {
+		qm, err := newQuotaManager(context.Background(), &volumeOptions{Path: dir, QuotaManager: "xfs"}, &netShareManager{}, &seqCommander{outs: tc.outs})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		err = qm.setQuota(tc.share, oneGB)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+
+	qm, err := newQuotaManager(context.Background(), &volumeOptions{Path: dir, QuotaManager: "xfs"}, &netShareManager{}, &fakeCommander{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = qm.removeQuota("csi-cifs-testvol"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestXfsQuoteArg(t *testing.T) {
+	tests := []struct {
+		arg    string
+		exp    string
+		errors bool
+	}{
+		{arg: "/srv/samba/csi-cifs-testvol", exp: `"/srv/samba/csi-cifs-testvol"`, errors: false},
+		{arg: "/srv/my shares/csi-cifs-testvol", exp: `"/srv/my shares/csi-cifs-testvol"`, errors: false},
+		{arg: `/srv/"shares"`, errors: true},
+	}
+
+	for _, tc := range tests {
+		quoted, err := xfsQuoteArg(tc.arg)
+		if err != nil && !tc.errors {
+			t.Errorf("%q: unexpected error %v", tc.arg, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%q: expected error, but not got any error", tc.arg)
+		}
+		if err == nil && quoted != tc.exp {
+			t.Errorf("%q: expected %s, but got %s", tc.arg, tc.exp, quoted)
+		}
+	}
+}
+
+func TestDfreeQuotaManager(t *testing.T) {
+	sm := &optionsShareManager{opts: make(map[string]map[string]string)}
+
+	tests := []struct {
+		name    string
+		command string
+		exp     string
+	}{
+		{name: "Default", command: "", exp: "/usr/local/bin/csi-cifs-dfree 1073741824"},
+		{name: "Custom command", command: "/opt/dfree", exp: "/opt/dfree 1073741824"},
+	}
+
+	for _, tc := range tests {
+		qm, err := newQuotaManager(context.Background(), &volumeOptions{QuotaManager: "dfree", DfreeCommand: tc.command}, sm, &fakeCommander{})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		if err = qm.setQuota("csi-cifs-testvol", oneGB); err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if exp := map[string]string{"dfree command": tc.exp}; !reflect.DeepEqual(sm.opts["csi-cifs-testvol"], exp) {
+			t.Errorf("%s: expected share options %v, but got %v", tc.name, exp, sm.opts["csi-cifs-testvol"])
+		}
+	}
+}
+
+func TestXfsProjectID(t *testing.T) {
+	a, b := xfsProjectID("csi-cifs-a"), xfsProjectID("csi-cifs-b")
+	if a == 0 || b == 0 {
+		t.Errorf("expected nonzero project IDs, but got %d and %d", a, b)
+	}
+	if a == b {
+		t.Errorf("expected different project IDs, but got %d for both", a)
+	}
+	if a != xfsProjectID("csi-cifs-a") {
+		t.Errorf("expected stable project IDs")
+	}
+}
+
+func TestFindMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-cifs-quota-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mp, err := findMountPoint(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.HasPrefix(dir, mp) {
+		t.Errorf("expected a parent of %s, but got %s", dir, mp)
+	}
+	if mp == dir {
+		t.Errorf("expected %s not to be a mount point", dir)
+	}
+}
@@ -0,0 +1,128 @@
+package cifs
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// nonBlockingGRPCServer is csicommon's NonBlockingGRPCServer, except
+// that it doesn't log the secrets passed in CSI requests.
+type nonBlockingGRPCServer struct {
+	wg     sync.WaitGroup
+	server *grpc.Server
+}
+
+var _ csicommon.NonBlockingGRPCServer = &nonBlockingGRPCServer{}
+
+func newNonBlockingGRPCServer() *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{}
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	s.wg.Add(1)
+
+	go s.serve(endpoint, ids, cs, ns)
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+}
+
+func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	scheme, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		glog.Fatal(err.Error())
+	}
+
+	if scheme == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			glog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+		}
+	}
+
+	listener, err := net.Listen(scheme, addr)
+	if err != nil {
+		glog.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	s.server = server
+
+	if ids != nil {
+		csi.RegisterIdentityServer(server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
+
+	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+
+	server.Serve(listener)
+}
+
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	glog.V(5).Infof("GRPC request: %+v", stripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("GRPC error: %v", redactSecrets(err.Error()))
+	} else {
+		glog.V(5).Infof("GRPC response: %+v", resp)
+	}
+	return resp, err
+}
+
+const strippedSecret = "****"
+
+// stripSecrets returns a copy of the CSI message msg with the values
+// of all its secrets fields masked.
+func stripSecrets(msg interface{}) interface{} {
+	m, ok := msg.(proto.Message)
+	if !ok || reflect.ValueOf(m).IsNil() {
+		return msg
+	}
+
+	c := proto.Clone(m)
+	v := reflect.ValueOf(c).Elem()
+	if v.Kind() != reflect.Struct {
+		return c
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() != reflect.Map || f.Len() == 0 || !strings.HasSuffix(v.Type().Field(i).Name, "Secrets") {
+			continue
+		}
+
+		stripped := reflect.MakeMap(f.Type())
+		for _, k := range f.MapKeys() {
+			stripped.SetMapIndex(k, reflect.ValueOf(strippedSecret))
+		}
+		f.Set(stripped)
+	}
+
+	return c
+}
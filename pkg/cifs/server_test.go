@@ -0,0 +1,35 @@
+package cifs
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestStripSecrets(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:    "testvol",
+		Secrets: map[string]string{"admin_name": "user", "admin_password": "pass"},
+	}
+
+	stripped, ok := stripSecrets(req).(*csi.CreateVolumeRequest)
+	if !ok {
+		t.Fatalf("expected *csi.CreateVolumeRequest, but got %T", stripSecrets(req))
+	}
+
+	if stripped.Name != req.Name {
+		t.Errorf("expected name %s, but got %s", req.Name, stripped.Name)
+	}
+	for k, v := range stripped.Secrets {
+		if v != strippedSecret {
+			t.Errorf("expected secret %s to be stripped, but got %s", k, v)
+		}
+	}
+	if req.Secrets["admin_password"] != "pass" {
+		t.Errorf("expected the original request to be left unchanged")
+	}
+
+	if stripSecrets(nil) != nil {
+		t.Errorf("expected nil")
+	}
+}
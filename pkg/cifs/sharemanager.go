@@ -0,0 +1,336 @@
+package cifs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	netShareManagerName    = "net"
+	subdirShareManagerName = "subdir"
+
+	defaultShareManager = netShareManagerName
+)
+
+// shareInfo describes a share exported by a CIFS server.
+type shareInfo struct {
+	Name    string
+	Path    string
+	Comment string
+}
+
+// errShareNotFound is returned by share managers when the share doesn't exist.
+var errShareNotFound = errors.New("share not found")
+
+// shareManager manages the shares exported by a single CIFS server.
+type shareManager interface {
+	createShare(s *shareInfo) error
+	deleteShare(name string) error
+	getShare(name string) (*shareInfo, error)
+	listShares() ([]string, error)
+	setShareOptions(name string, opts map[string]string) error
+	// withShareDir calls f with the path of the directory of the share
+	// on the controller.
+	withShareDir(name string, f func(dir string) error) error
+	// withRootDir calls f with the path of the directory under which
+	// shares are created on the controller.
+	withRootDir(f func(dir string) error) error
+}
+
+type shareManagerFactory func(ctx context.Context, volOptions *volumeOptions, cr *credentials, c Interface, m mount.Interface) shareManager
+
+var shareManagers = map[string]shareManagerFactory{
+	netShareManagerName:    newNetShareManager,
+	subdirShareManagerName: newSubdirShareManager,
+}
+
+// newShareManager returns the share manager selected by volOptions.
+// The commands issued by the share manager are canceled when ctx is done.
+// If c or m are not nil, they are used to run all the commands and mounts issued by the share manager.
+func newShareManager(ctx context.Context, volOptions *volumeOptions, cr *credentials, c Interface, m mount.Interface) (shareManager, error) {
+	name := volOptions.ShareManager
+	if name == "" {
+		name = defaultShareManager
+	}
+
+	f, ok := shareManagers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown share manager %q, supported share managers are %v", name, shareManagerNames())
+	}
+
+	return f(ctx, volOptions, cr, c, m), nil
+}
+
+func shareManagerNames() []string {
+	names := make([]string, 0, len(shareManagers))
+	for name := range shareManagers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// netShareManager manages shares via `net rpc share`. The directories of
+// its shares are accessed under the path under which shares are created,
+// which requires the controller to run on the CIFS server with that path
+// mounted at the same location.
+type netShareManager struct {
+	ctx       context.Context
+	server    string
+	dir       string
+	cr        *credentials
+	commander Interface
+}
+
+var _ shareManager = &netShareManager{}
+
+func newNetShareManager(ctx context.Context, volOptions *volumeOptions, cr *credentials, c Interface, m mount.Interface) shareManager {
+	return &netShareManager{ctx: ctx, server: volOptions.Server, dir: volOptions.Path, cr: cr, commander: c}
+}
+
+func (m *netShareManager) run(args ...string) ([]byte, error) {
+	debug := "1"
+	if glog.V(4) {
+		debug = "4"
+	}
+
+	authArgs, env, cleanup, err := m.auth()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args = append(args, "-S", m.server, "-d", debug)
+	args = append(args, authArgs...)
+
+	c := m.commander
+	if c == nil {
+		c = &commander{cmd: "net", options: args, env: env}
+	}
+
+	out, err := c.execCommand(m.ctx)
+	if err != nil {
+		if isNetShareNotFound(out) {
+			return out, errShareNotFound
+		}
+		return out, classifyCommandError("net", err, out)
+	}
+
+	return out, nil
+}
+
+// auth returns the options and the environment net authenticates with,
+// and a function removing the files they refer to.
+func (m *netShareManager) auth() ([]string, []string, func(), error) {
+	switch {
+	case m.cr.machineAccount:
+		// $ net ... -P
+		return []string{"-P"}, nil, func() {}, nil
+
+	case len(m.cr.keytab) > 0:
+		dir, err := ioutil.TempDir("", "csi-cifs-krb5-")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create Kerberos directory: %v", err)
+		}
+		cleanup := func() { os.RemoveAll(dir) }
+
+		keytabPath := filepath.Join(dir, "keytab")
+		ccache := "FILE:" + filepath.Join(dir, "krb5cc")
+
+		if err = ioutil.WriteFile(keytabPath, m.cr.keytab, 0600); err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("failed to write admin keytab: %v", err)
+		}
+
+		// $ kinit -k -t KEYTAB -c FILE:CCACHE PRINCIPAL
+		if err = kinit(m.ctx, m.commander, nil, "-k", "-t", keytabPath, "-c", ccache, adminPrincipal(m.cr)); err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+
+		// $ KRB5CCNAME=FILE:CCACHE net ... -k
+		return []string{"-k"}, []string{"KRB5CCNAME=" + ccache}, cleanup, nil
+
+	default:
+		credFile, err := writeCredentialsFile(m.cr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// $ net ... -A CREDENTIALS_FILE
+		return []string{"-A", credFile}, nil, func() { os.Remove(credFile) }, nil
+	}
+}
+
+// adminPrincipal returns the Kerberos principal of the admin credentials cr.
+// Active Directory realms are the DNS domain names in upper case, so a DNS
+// domain is appended to bare usernames as their realm.
+func adminPrincipal(cr *credentials) string {
+	if strings.Contains(cr.username, "@") || !strings.Contains(cr.domain, ".") {
+		return cr.username
+	}
+
+	return cr.username + "@" + strings.ToUpper(cr.domain)
+}
+
+func (m *netShareManager) createShare(s *shareInfo) error {
+	// $ net rpc share add SHARE_NAME=/PATH/TO/SHARE COMMENT -S server -d 4
+	_, err := m.run("rpc", "share", "add", s.Name+"="+s.Path, s.Comment)
+	return err
+}
+
+func (m *netShareManager) deleteShare(name string) error {
+	// $ net rpc share delete SHARE_NAME -S server -d 4
+	_, err := m.run("rpc", "share", "delete", name)
+	return err
+}
+
+func (m *netShareManager) getShare(name string) (*shareInfo, error) {
+	// $ net rpc share info SHARE_NAME -S server -d 4
+	out, err := m.run("rpc", "share", "info", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseNetShareInfo(name, out), nil
+}
+
+func (m *netShareManager) listShares() ([]string, error) {
+	// $ net rpc share list -S server -d 4
+	out, err := m.run("rpc", "share", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseNetShareList(out), nil
+}
+
+func (m *netShareManager) setShareOptions(name string, opts map[string]string) error {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// $ net rpc conf setparm SHARE_NAME PARAMETER VALUE -S server -d 4
+	for _, k := range keys {
+		if _, err := m.run("rpc", "conf", "setparm", name, k, opts[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *netShareManager) withShareDir(name string, f func(dir string) error) error {
+	if m.dir == "" {
+		return fmt.Errorf("the directory of share %s is unknown, path is not set", name)
+	}
+
+	dir := filepath.Join(m.dir, name)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errShareNotFound
+		}
+		return err
+	}
+
+	return f(dir)
+}
+
+func (m *netShareManager) withRootDir(f func(dir string) error) error {
+	if m.dir == "" {
+		return errors.New("the directory of shares is unknown, path is not set")
+	}
+
+	return f(m.dir)
+}
+
+// netShareNotFoundErrors are the errors reported by net when a share doesn't exist.
+var netShareNotFoundErrors = []string{
+	"WERR_NERR_NETNAMENOTFOUND",
+	"WERR_NET_NAME_NOT_FOUND",
+	"NERR_NetNameNotFound",
+	"NT_STATUS_BAD_NETWORK_NAME",
+	"The share name could not be found",
+}
+
+// isNetShareNotFound reports whether out is the output of a net command
+// which failed because the share doesn't exist.
+func isNetShareNotFound(out []byte) bool {
+	for _, e := range netShareNotFoundErrors {
+		if bytes.Contains(out, []byte(e)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNetShareInfo parses the output of `net rpc share info`:
+//
+//	netname: SHARE_NAME
+//		remark: COMMENT
+//		path: C:\PATH\TO\SHARE
+//		password: (null)
+func parseNetShareInfo(name string, out []byte) *shareInfo {
+	s := &shareInfo{Name: name}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(sc.Text()), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		v := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "netname":
+			s.Name = v
+		case "remark":
+			s.Comment = v
+		case "path":
+			s.Path = v
+		}
+	}
+
+	return s
+}
+
+// cleanSharePath returns the share path p reported by `net rpc share info`
+// as an absolute path, without the drive letter and backslashes Samba
+// reports paths with.
+func cleanSharePath(p string) string {
+	if len(p) >= 2 && p[1] == ':' {
+		p = p[2:]
+	}
+
+	return path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+}
+
+// parseNetShareList parses the output of `net rpc share list`, one share name per line.
+func parseNetShareList(out []byte) []string {
+	var shares []string
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if name := strings.TrimSpace(sc.Text()); name != "" {
+			shares = append(shares, name)
+		}
+	}
+
+	return shares
+}
@@ -0,0 +1,183 @@
+package cifs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestNewShareManager(t *testing.T) {
+	tests := []struct {
+		name   string
+		sm     string
+		errors bool
+	}{
+		{name: "Default", sm: "", errors: false},
+		{name: "net", sm: "net", errors: false},
+		{name: "subdir", sm: "subdir", errors: false},
+		{name: "Fail due to unknown share manager", sm: "foo", errors: true},
+	}
+
+	for _, tc := range tests {
+		_, err := newShareManager(context.Background(), &volumeOptions{Server: "192.168.122.1", ShareManager: tc.sm}, &credentials{}, &fakeCommander{}, &mount.FakeMounter{})
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+}
+
+func TestNetShareManagerAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		cr   *credentials
+		args []string
+		env  string
+	}{
+		{name: "Password", cr: &credentials{username: "admin", password: "pass"}, args: []string{"-A"}},
+		{name: "Keytab", cr: &credentials{username: "admin", keytab: []byte("KEYTAB")}, args: []string{"-k"}, env: "KRB5CCNAME=FILE:"},
+		{name: "Machine account", cr: &credentials{machineAccount: true}, args: []string{"-P"}},
+	}
+
+	for _, tc := range tests {
+		m := &netShareManager{ctx: context.Background(), cr: tc.cr, commander: &fakeCommander{}}
+
+		args, env, cleanup, err := m.auth()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		if len(args) == 0 || args[0] != tc.args[0] {
+			t.Errorf("%s: expected options %v, but got %v", tc.name, tc.args, args)
+		}
+		if tc.env == "" && len(env) != 0 || tc.env != "" && (len(env) != 1 || !strings.HasPrefix(env[0], tc.env)) {
+			t.Errorf("%s: expected environment %q, but got %v", tc.name, tc.env, env)
+		}
+
+		// The files the options refer to are removed by cleanup
+		var files []string
+		if args[0] == "-A" {
+			files = append(files, args[1])
+		}
+		if len(env) == 1 {
+			files = append(files, filepath.Dir(strings.TrimPrefix(env[0], "KRB5CCNAME=FILE:")))
+		}
+		cleanup()
+		for _, f := range files {
+			if _, err = os.Stat(f); !os.IsNotExist(err) {
+				t.Errorf("%s: expected %s to be removed, but got %v", tc.name, f, err)
+			}
+		}
+	}
+}
+
+func TestAdminPrincipal(t *testing.T) {
+	tests := []struct {
+		cr  *credentials
+		exp string
+	}{
+		{cr: &credentials{username: "admin"}, exp: "admin"},
+		{cr: &credentials{username: "admin", domain: "EXAMPLE"}, exp: "admin"},
+		{cr: &credentials{username: "admin", domain: "example.com"}, exp: "admin@EXAMPLE.COM"},
+		{cr: &credentials{username: "admin@EXAMPLE.ORG", domain: "example.com"}, exp: "admin@EXAMPLE.ORG"},
+	}
+
+	for _, tc := range tests {
+		if p := adminPrincipal(tc.cr); p != tc.exp {
+			t.Errorf("%+v: expected %q, but got %q", tc.cr, tc.exp, p)
+		}
+	}
+}
+
+func TestParseNetShareInfo(t *testing.T) {
+	out := []byte("netname: csi-cifs-testvol\n\tremark: testvol\n\tpath: C:\\tmp\\csi-cifs-testvol\n\tpassword: (null)\n")
+
+	exp := &shareInfo{Name: "csi-cifs-testvol", Comment: "testvol", Path: "C:\\tmp\\csi-cifs-testvol"}
+	if s := parseNetShareInfo("csi-cifs-testvol", out); !reflect.DeepEqual(s, exp) {
+		t.Errorf("expected %+v, but got %+v", exp, s)
+	}
+}
+
+func TestParseNetShareList(t *testing.T) {
+	out := []byte("print$\ncsi-cifs-testvol\n\nIPC$\n")
+
+	exp := []string{"print$", "csi-cifs-testvol", "IPC$"}
+	if s := parseNetShareList(out); !reflect.DeepEqual(s, exp) {
+		t.Errorf("expected %v, but got %v", exp, s)
+	}
+}
+
+func TestIsNetShareNotFound(t *testing.T) {
+	tests := []struct {
+		out string
+		exp bool
+	}{
+		{out: "Failed to delete share: WERR_NERR_NETNAMENOTFOUND\n", exp: true},
+		{out: "Could not connect to server 192.168.122.1\nConnection failed: NT_STATUS_CONNECTION_REFUSED\n", exp: false},
+		{out: "", exp: false},
+	}
+
+	for _, tc := range tests {
+		if b := isNetShareNotFound([]byte(tc.out)); b != tc.exp {
+			t.Errorf("%q: expected %v, but got %v", tc.out, tc.exp, b)
+		}
+	}
+}
+
+func TestSubdirPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		subdir string
+		exp    string
+		errors bool
+	}{
+		{name: "Success", subdir: "csi-cifs-testvol", exp: "/mnt/k8s/csi-cifs-testvol", errors: false},
+		{name: "Fail due to empty name", subdir: "", errors: true},
+		{name: "Fail due to parent", subdir: "..", errors: true},
+		{name: "Fail due to nested path", subdir: "a/../../b", errors: true},
+		{name: "Fail due to absolute path", subdir: "/etc", errors: true},
+	}
+
+	for _, tc := range tests {
+		p, err := subdirPath("/mnt/k8s", tc.subdir)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+		if err == nil && p != tc.exp {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.exp, p)
+		}
+	}
+}
+
+func TestIsRelativeSubdir(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  bool
+	}{
+		{path: "", exp: true},
+		{path: "k8s/vols", exp: true},
+		{path: "k8s/../vols", exp: true},
+		{path: "..foo", exp: true},
+		{path: "..", exp: false},
+		{path: "k8s/../..", exp: false},
+		{path: "../vols", exp: false},
+		{path: "/k8s", exp: false},
+	}
+
+	for _, tc := range tests {
+		if ok := isRelativeSubdir(tc.path); ok != tc.exp {
+			t.Errorf("%q: expected %v, got %v", tc.path, tc.exp, ok)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cifs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	snapshotCacheRoot = PluginFolder + "/controller/snapshot-cache"
+)
+
+type snapshotCacheEntry struct {
+	SnapshotID     snapshotID
+	SnapshotName   string
+	SourceVolumeID volumeID
+	CreationTime   int64
+	SizeBytes      int64
+}
+
+type snapshotCacheMap map[snapshotID]*snapshotCacheEntry
+
+var (
+	snapCache    = make(snapshotCacheMap)
+	snapCacheMtx sync.Mutex
+
+	// snapCacheStore persists the entries of snapCache
+	snapCacheStore controllerCacheStore = &fileControllerCacheStore{root: snapshotCacheRoot}
+)
+
+// decodeSnapshotCacheEntry decodes an encoded cache entry.
+func decodeSnapshotCacheEntry(data []byte) (*snapshotCacheEntry, error) {
+	ent := &snapshotCacheEntry{}
+	if err := json.Unmarshal(data, ent); err != nil {
+		return nil, err
+	}
+	if ent.SnapshotID == "" {
+		return nil, errors.New("missing snapshot ID")
+	}
+
+	return ent, nil
+}
+
+// Load all entries from snapCacheStore into snapCache, replacing its contents
+// Called from driver.go's Init()
+func loadSnapshotCache() error {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	for snapId := range snapCache {
+		delete(snapCache, snapId)
+	}
+
+	return snapCacheStore.load(func(data []byte) error {
+		ent, err := decodeSnapshotCacheEntry(data)
+		if err != nil {
+			return err
+		}
+
+		snapCache[ent.SnapshotID] = ent
+		return nil
+	})
+}
+
+func (m snapshotCacheMap) insert(ent *snapshotCacheEntry) error {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	data, err := json.Marshal(ent)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry for snapshot %s: %v", ent.SnapshotID, err)
+	}
+
+	if err = snapCacheStore.save(string(ent.SnapshotID), data); err != nil {
+		return err
+	}
+
+	m[ent.SnapshotID] = ent
+
+	return nil
+}
+
+func (m snapshotCacheMap) get(snapId snapshotID) (*snapshotCacheEntry, bool) {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	ent, ok := m[snapId]
+	return ent, ok
+}
+
+func (m snapshotCacheMap) getByName(name string) (*snapshotCacheEntry, bool) {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	for _, ent := range m {
+		if ent.SnapshotName == name {
+			return ent, true
+		}
+	}
+
+	return nil, false
+}
+
+// list returns the cache entries sorted by snapshot ID.
+func (m snapshotCacheMap) list() []*snapshotCacheEntry {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	ents := make([]*snapshotCacheEntry, 0, len(m))
+	for _, ent := range m {
+		ents = append(ents, ent)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].SnapshotID < ents[j].SnapshotID })
+
+	return ents
+}
+
+func (m snapshotCacheMap) pop(snapId snapshotID) (*snapshotCacheEntry, error) {
+	snapCacheMtx.Lock()
+	defer snapCacheMtx.Unlock()
+
+	ent, ok := m[snapId]
+	if !ok {
+		return nil, fmt.Errorf("cache entry for snapshot %s does not exist", snapId)
+	}
+
+	if err := snapCacheStore.remove(string(snapId)); err != nil {
+		return nil, err
+	}
+
+	delete(m, snapId)
+
+	return ent, nil
+}
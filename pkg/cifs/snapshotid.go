@@ -0,0 +1,147 @@
+package cifs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot IDs encode how the snapshot was taken, the share of its source
+// volume and its shadow copy so that the snapshot can be deleted and
+// restored without any local state:
+//
+//	csi-cifs-snap-v1#SNAPSHOTTER#SHARE_MANAGER#SERVER#SHARE#PATH#PATH_HASH#NAME#TIME
+//
+// Each field is query-escaped. As in volume IDs, the path of net shares is
+// only encoded as PATH_HASH, while SHARE and PATH are the base share and the
+// path of subdirectories. NAME is the name of the share or subdirectory
+// without the csi-cifs- prefix all of them have, and TIME is the Unix time
+// of the shadow copy, which keeps snapshot IDs within the CSI limit of 128
+// bytes.
+const (
+	snapshotIDPrefix    = "csi-cifs-snap-"
+	snapshotIDVersion   = "v1"
+	snapshotIDSeparator = "#"
+
+	snapshotIDFields = 9
+)
+
+type snapshotID string
+
+// newSnapshotID returns the ID of the snapshot of the volume described by
+// volOptions taken by the snapshotter named snapshotter at t.
+func newSnapshotID(snapshotter string, volOptions *volumeOptions, t time.Time) snapshotID {
+	var share, dir, pathHash string
+	if volOptions.ShareManager == subdirShareManagerName {
+		share, dir = volOptions.Share, volOptions.Path
+	} else {
+		pathHash = volOptions.pathHash()
+	}
+
+	fields := []string{
+		snapshotIDPrefix + snapshotIDVersion,
+		url.QueryEscape(snapshotter),
+		url.QueryEscape(volOptions.ShareManager),
+		url.QueryEscape(volOptions.Server),
+		url.QueryEscape(share),
+		url.QueryEscape(dir),
+		pathHash,
+		url.QueryEscape(strings.TrimPrefix(volOptions.shareName(), volumeIDPrefix)),
+		strconv.FormatInt(t.Unix(), 10),
+	}
+
+	return snapshotID(strings.Join(fields, snapshotIDSeparator))
+}
+
+// decodeSnapshotID returns the snapshotter, the options of the source volume
+// and the shadow copy encoded in the snapshot ID snapId. Only the options
+// locating the share of the source volume are set, and as for volume IDs,
+// the options of net volumes hold the hash of their path in PathHash.
+func decodeSnapshotID(snapId snapshotID) (string, *volumeOptions, string, error) {
+	fields := strings.Split(string(snapId), snapshotIDSeparator)
+	if fields[0] != snapshotIDPrefix+snapshotIDVersion {
+		return "", nil, "", fmt.Errorf("snapshot ID %s is not a versioned snapshot ID", snapId)
+	}
+	if len(fields) != snapshotIDFields {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: expected %d fields, got %d", snapId, snapshotIDFields, len(fields))
+	}
+
+	for i := range fields {
+		f, err := url.QueryUnescape(fields[i])
+		if err != nil {
+			return "", nil, "", fmt.Errorf("malformed snapshot ID %s: %v", snapId, err)
+		}
+		fields[i] = f
+	}
+
+	snapshotter := fields[1]
+	if _, ok := snapshotters[snapshotter]; !ok {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: unknown snapshotter %q", snapId, snapshotter)
+	}
+
+	o := &volumeOptions{ShareManager: fields[2], Server: fields[3], PathHash: fields[6]}
+	if _, ok := shareManagers[o.ShareManager]; !ok {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: unknown share manager %q", snapId, o.ShareManager)
+	}
+	if o.Server == "" {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: missing server", snapId)
+	}
+	if !isSubdirName(fields[7]) {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: invalid share name %q", snapId, fields[7])
+	}
+	if b, err := hex.DecodeString(o.PathHash); o.PathHash != "" && (err != nil || len(b) != 8) {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: invalid path hash %q", snapId, o.PathHash)
+	}
+
+	if o.ShareManager == subdirShareManagerName {
+		if fields[4] == "" || o.PathHash != "" || !isRelativeSubdir(fields[5]) {
+			return "", nil, "", fmt.Errorf("malformed snapshot ID %s: invalid share or path of subdirectory", snapId)
+		}
+		o.Share, o.Path = fields[4], fields[5]
+	} else if fields[4] != "" || fields[5] != "" {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: unexpected share or path of %s share", snapId, o.ShareManager)
+	}
+	o.assignShare(volumeIDPrefix + fields[7])
+
+	sec, err := strconv.ParseInt(fields[8], 10, 64)
+	if err != nil || sec <= 0 {
+		return "", nil, "", fmt.Errorf("malformed snapshot ID %s: invalid time %q", snapId, fields[8])
+	}
+
+	return snapshotter, o, shadowCopyName(time.Unix(sec, 0)), nil
+}
+
+// getSnapshotSource returns the snapshotter, the options of the source
+// volume and the shadow copy of the snapshot snapId. The path of net volumes
+// is taken from the cached volumes with the same path, if any.
+func getSnapshotSource(snapId snapshotID) (string, *volumeOptions, string, error) {
+	snapshotter, o, shadowCopy, err := decodeSnapshotID(snapId)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	resolveCachedPath(o)
+
+	return snapshotter, o, shadowCopy, nil
+}
+
+// shadowCopyFormat is the default shadow:format of Samba's shadow_copy2 VFS module.
+const shadowCopyFormat = "@GMT-2006.01.02-15.04.05"
+
+// shadowCopyName returns the name of the shadow copy directory of a snapshot taken at t.
+func shadowCopyName(t time.Time) string {
+	return t.UTC().Format(shadowCopyFormat)
+}
+
+// parseShadowCopyName returns the time at which the shadow copy named name was taken.
+func parseShadowCopyName(name string) (time.Time, error) {
+	t, err := time.Parse(shadowCopyFormat, name)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a shadow copy name", name)
+	}
+
+	return t, nil
+}
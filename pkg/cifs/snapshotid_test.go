@@ -0,0 +1,120 @@
+package cifs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotID(t *testing.T) {
+	ts := time.Date(2019, 3, 1, 10, 20, 30, 0, time.UTC)
+	shadowCopy := shadowCopyName(ts)
+
+	if shadowCopy != "@GMT-2019.03.01-10.20.30" {
+		t.Errorf("expected shadow copy @GMT-2019.03.01-10.20.30, but got %s", shadowCopy)
+	}
+
+	shareName := newShareName("pvc-3c9e4c5f-3a5e-11e9-b210-d663bd873d93")
+
+	tests := []struct {
+		name       string
+		volOptions *volumeOptions
+	}{
+		{
+			name:       "net",
+			volOptions: &volumeOptions{ShareManager: "net", Server: "fileserver01.example.com", Path: "/srv/samba/kubernetes/persistent-volumes"},
+		},
+		{
+			name:       "subdir",
+			volOptions: &volumeOptions{ShareManager: "subdir", Server: "192.168.122.1", Share: "vols", Path: "k8s"},
+		},
+		{
+			name:       "subdir without path",
+			volOptions: &volumeOptions{ShareManager: "subdir", Server: "192.168.122.1", Share: "vols"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc.volOptions.assignShare(shareName)
+
+		snapId := newSnapshotID("reflink", tc.volOptions, ts)
+		if len(snapId) > maxIDLength {
+			t.Errorf("%s: expected snapshot ID %s to be at most %d bytes, but got %d", tc.name, snapId, maxIDLength, len(snapId))
+		}
+
+		// Only the hash of the path of net volumes is encoded
+		exp := *tc.volOptions
+		if exp.ShareManager != subdirShareManagerName {
+			exp.Path, exp.PathHash = "", hashPath(exp.Path)
+		}
+
+		snapshotter, o, s, err := decodeSnapshotID(snapId)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if snapshotter != "reflink" || s != shadowCopy {
+			t.Errorf("%s: expected reflink and %s, but got %s and %s", tc.name, shadowCopy, snapshotter, s)
+		}
+		if !reflect.DeepEqual(o, &exp) {
+			t.Errorf("%s: expected %+v, but got %+v", tc.name, &exp, o)
+		}
+	}
+}
+
+func TestDecodeSnapshotID(t *testing.T) {
+	tests := []struct {
+		name   string
+		snapId snapshotID
+		errors bool
+	}{
+		{name: "Success", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1###3c37ed948a1169e2#testvol#1551435630", errors: false},
+		{name: "Success with subdir", snapId: "csi-cifs-snap-v1#copy#subdir#192.168.122.1#vols#k8s##testvol#1551435630", errors: false},
+		{name: "Fail due to volume ID", snapId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol####", errors: true},
+		{name: "Fail due to missing fields", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1#testvol#1551435630", errors: true},
+		{name: "Fail due to unknown snapshotter", snapId: "csi-cifs-snap-v1#foo#net#192.168.122.1####testvol#1551435630", errors: true},
+		{name: "Fail due to unknown share manager", snapId: "csi-cifs-snap-v1#copy#foo#192.168.122.1####testvol#1551435630", errors: true},
+		{name: "Fail due to missing server", snapId: "csi-cifs-snap-v1#copy#net#####testvol#1551435630", errors: true},
+		{name: "Fail due to missing share name", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1#####1551435630", errors: true},
+		{name: "Fail due to share name outside of path", snapId: "csi-cifs-snap-v1#copy#subdir#192.168.122.1#vols#k8s##..#1551435630", errors: true},
+		{name: "Fail due to path outside of share", snapId: "csi-cifs-snap-v1#copy#subdir#192.168.122.1#vols#..%2F..##testvol#1551435630", errors: true},
+		{name: "Fail due to missing base share", snapId: "csi-cifs-snap-v1#copy#subdir#192.168.122.1#####testvol#1551435630", errors: true},
+		{name: "Fail due to base share of net share", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1#vols###testvol#1551435630", errors: true},
+		{name: "Fail due to invalid path hash", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1###%2Fsrv#testvol#1551435630", errors: true},
+		{name: "Fail due to malformed time", snapId: "csi-cifs-snap-v1#copy#net#192.168.122.1####testvol#..%2F..%2Fetc", errors: true},
+	}
+
+	for _, tc := range tests {
+		_, _, _, err := decodeSnapshotID(tc.snapId)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+}
+
+func TestGetSnapshotSource(t *testing.T) {
+	volOptions := &volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testsnapsrc", Path: "/srv/samba"}
+	volId := newVolumeID(volOptions)
+	snapId := newSnapshotID("copy", volOptions, time.Date(2019, 3, 1, 10, 20, 30, 0, time.UTC))
+
+	// The path of uncached volumes is resolved from their share
+	_, o, _, err := getSnapshotSource(snapId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if o.Share != volOptions.Share || o.Path != "" || o.PathHash != hashPath(volOptions.Path) {
+		t.Errorf("expected share %s with path hash %s, but got %+v", volOptions.Share, hashPath(volOptions.Path), o)
+	}
+
+	if err = ctrCache.insert(&controllerCacheEntry{VolOptions: *volOptions, VolumeID: volId}); err != nil {
+		t.Fatalf("failed to insert cache entry: %v", err)
+	}
+	defer ctrCache.pop(volId)
+
+	if _, o, _, err = getSnapshotSource(snapId); err != nil || o.Path != volOptions.Path {
+		t.Errorf("expected path %s, but got %+v and %v", volOptions.Path, o, err)
+	}
+}
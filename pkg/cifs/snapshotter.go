@@ -0,0 +1,191 @@
+package cifs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	copySnapshotterName    = "copy"
+	reflinkSnapshotterName = "reflink"
+	btrfsSnapshotterName   = "btrfs"
+
+	defaultSnapshotter = copySnapshotterName
+
+	// shadowCopyDir is the default shadow:snapdir of Samba's shadow_copy2
+	// VFS module. Snapshots are taken to SHARE/.snapshots/@GMT-... so that
+	// they are also listed as previous versions of the share.
+	shadowCopyDir = ".snapshots"
+)
+
+// errSnapshotExists is returned by snapshotters when the shadow copy already exists.
+var errSnapshotExists = errors.New("shadow copy already exists")
+
+// snapshotter takes snapshots of share directories.
+type snapshotter interface {
+	createSnapshot(shareDir, snapDir string) error
+	deleteSnapshot(snapDir string) error
+}
+
+type snapshotterFactory func(ctx context.Context, c Interface) snapshotter
+
+var snapshotters = map[string]snapshotterFactory{
+	copySnapshotterName:    newCopySnapshotter,
+	reflinkSnapshotterName: newReflinkSnapshotter,
+	btrfsSnapshotterName:   newBtrfsSnapshotter,
+}
+
+// newSnapshotter returns the snapshotter named name.
+// The commands issued by the snapshotter are canceled when ctx is done.
+// If c is not nil, it is used to run all the commands issued by the snapshotter.
+func newSnapshotter(ctx context.Context, name string, c Interface) (snapshotter, error) {
+	if name == "" {
+		name = defaultSnapshotter
+	}
+
+	f, ok := snapshotters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshotter %q, supported snapshotters are %v", name, snapshotterNames())
+	}
+
+	return f(ctx, c), nil
+}
+
+func snapshotterNames() []string {
+	names := make([]string, 0, len(snapshotters))
+	for name := range snapshotters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// shadowCopyPath returns the path of the shadow copy named shadowCopy of shareDir.
+func shadowCopyPath(shareDir, shadowCopy string) string {
+	return filepath.Join(shareDir, shadowCopyDir, shadowCopy)
+}
+
+func runCommand(ctx context.Context, c Interface, cmd string, args ...string) error {
+	if c == nil {
+		c = &commander{cmd: cmd, options: args}
+	}
+
+	if out, err := c.execCommand(ctx); err != nil {
+		return commandError(cmd, err, out)
+	}
+
+	return nil
+}
+
+// copyShareDir copies the contents of the share directory srcDir except
+// its shadow copies to dstDir. `cp -a` preserves ownership, timestamps and
+// extended attributes, including ACLs.
+func copyShareDir(ctx context.Context, c Interface, srcDir, dstDir string, reflink bool) error {
+	fis, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+
+	// $ cp -a [--reflink=always] SRC/ENTRY... DST/
+	args := []string{"-a"}
+	if reflink {
+		args = append(args, "--reflink=always")
+	}
+
+	n := len(args)
+	for _, fi := range fis {
+		if fi.Name() != shadowCopyDir {
+			args = append(args, filepath.Join(srcDir, fi.Name()))
+		}
+	}
+	if len(args) == n {
+		return nil
+	}
+	args = append(args, dstDir+"/")
+
+	return runCommand(ctx, c, "cp", args...)
+}
+
+// copySnapshotter copies the share directory with `cp`,
+// optionally sharing the data with reflinks.
+type copySnapshotter struct {
+	ctx       context.Context
+	reflink   bool
+	commander Interface
+}
+
+var _ snapshotter = &copySnapshotter{}
+
+func newCopySnapshotter(ctx context.Context, c Interface) snapshotter {
+	return &copySnapshotter{ctx: ctx, commander: c}
+}
+
+// newReflinkSnapshotter returns a snapshotter for filesystems which support
+// reflinks, such as btrfs and XFS, which shares the data with the volume.
+func newReflinkSnapshotter(ctx context.Context, c Interface) snapshotter {
+	return &copySnapshotter{ctx: ctx, reflink: true, commander: c}
+}
+
+func (s *copySnapshotter) createSnapshot(shareDir, snapDir string) error {
+	if _, err := os.Stat(snapDir); err == nil {
+		return errSnapshotExists
+	}
+
+	if err := os.MkdirAll(snapDir, 0755); err != nil {
+		return err
+	}
+
+	if err := copyShareDir(s.ctx, s.commander, shareDir, snapDir, s.reflink); err != nil {
+		os.RemoveAll(snapDir)
+		return err
+	}
+
+	return nil
+}
+
+func (s *copySnapshotter) deleteSnapshot(snapDir string) error {
+	return os.RemoveAll(snapDir)
+}
+
+// btrfsSnapshotter takes read-only btrfs snapshots of share directories,
+// which have to be btrfs subvolumes. Shadow copies are subvolumes themselves,
+// so they are not included in the snapshots.
+type btrfsSnapshotter struct {
+	ctx       context.Context
+	commander Interface
+}
+
+var _ snapshotter = &btrfsSnapshotter{}
+
+func newBtrfsSnapshotter(ctx context.Context, c Interface) snapshotter {
+	return &btrfsSnapshotter{ctx: ctx, commander: c}
+}
+
+func (s *btrfsSnapshotter) createSnapshot(shareDir, snapDir string) error {
+	if _, err := os.Stat(snapDir); err == nil {
+		return errSnapshotExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(snapDir), 0755); err != nil {
+		return err
+	}
+
+	// $ btrfs subvolume snapshot -r SHARE SHARE/.snapshots/@GMT-...
+	return runCommand(s.ctx, s.commander, "btrfs", "subvolume", "snapshot", "-r", shareDir, snapDir)
+}
+
+func (s *btrfsSnapshotter) deleteSnapshot(snapDir string) error {
+	if _, err := os.Stat(snapDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	// $ btrfs subvolume delete SHARE/.snapshots/@GMT-...
+	return runCommand(s.ctx, s.commander, "btrfs", "subvolume", "delete", snapDir)
+}
@@ -0,0 +1,63 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSnapshotters(t *testing.T) {
+	for _, name := range snapshotterNames() {
+		shareDir, err := ioutil.TempDir("", "csi-cifs-share-")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(shareDir)
+
+		if err = ioutil.WriteFile(filepath.Join(shareDir, "data"), []byte("data"), 0644); err != nil {
+			t.Fatalf("failed to write data: %v", err)
+		}
+
+		s, err := newSnapshotter(context.Background(), name, &fakeCommander{})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		snapDir := shadowCopyPath(shareDir, "@GMT-2019.03.01-10.20.30")
+		if err = s.createSnapshot(shareDir, snapDir); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if _, err = os.Stat(filepath.Dir(snapDir)); err != nil {
+			t.Errorf("%s: expected shadow copy directory, but got %v", name, err)
+		}
+		if err = s.deleteSnapshot(snapDir); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	if _, err := newSnapshotter(context.Background(), "foo", &fakeCommander{}); err == nil {
+		t.Errorf("expected error for unknown snapshotter, but not got any error")
+	}
+}
+
+func TestCopySnapshotterExists(t *testing.T) {
+	shareDir, err := ioutil.TempDir("", "csi-cifs-share-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(shareDir)
+
+	s := newCopySnapshotter(context.Background(), &fakeCommander{})
+	snapDir := shadowCopyPath(shareDir, "@GMT-2019.03.01-10.20.30")
+
+	if err = s.createSnapshot(shareDir, snapDir); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = s.createSnapshot(shareDir, snapDir); err != errSnapshotExists {
+		t.Errorf("expected %v, but got %v", errSnapshotExists, err)
+	}
+}
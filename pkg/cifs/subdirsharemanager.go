@@ -0,0 +1,225 @@
+package cifs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
+)
+
+const (
+	controllerMountRoot = PluginFolder + "/controller/mounts"
+
+	archivedSubdirPrefix = "archived-"
+)
+
+// subdirShareManager manages volumes as subdirectories of a single
+// pre-existing share, for servers which don't allow creating new shares.
+// The base share is mounted on the controller for each operation.
+type subdirShareManager struct {
+	ctx             context.Context
+	server          string
+	share           string
+	dir             string
+	archiveOnDelete bool
+
+	cr      *credentials
+	mounter mount.Interface
+}
+
+var _ shareManager = &subdirShareManager{}
+
+func newSubdirShareManager(ctx context.Context, volOptions *volumeOptions, cr *credentials, c Interface, m mount.Interface) shareManager {
+	if m == nil {
+		m = mount.New("")
+	}
+
+	return &subdirShareManager{
+		ctx:             ctx,
+		server:          volOptions.Server,
+		share:           volOptions.Share,
+		dir:             volOptions.Path,
+		archiveOnDelete: volOptions.ArchiveOnDelete,
+		cr:              cr,
+		mounter:         m,
+	}
+}
+
+// isRelativeSubdir reports whether p is a relative path which stays within
+// its parent directory once cleaned.
+func isRelativeSubdir(p string) bool {
+	if path.IsAbs(p) {
+		return false
+	}
+
+	p = path.Clean(p)
+	return p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// isSubdirName reports whether name is a single path element, other than
+// . and ..
+func isSubdirName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// subdirPath returns the path of the subdirectory name of root.
+func subdirPath(root, name string) (string, error) {
+	if !isSubdirName(name) {
+		return "", fmt.Errorf("invalid subdirectory name %q", name)
+	}
+
+	return filepath.Join(root, name), nil
+}
+
+// withBaseShare mounts the base share and calls f with the path of
+// the volumes directory within the mount.
+func (m *subdirShareManager) withBaseShare(f func(root string) error) error {
+	if !isRelativeSubdir(m.dir) {
+		return fmt.Errorf("path %s is outside of share %s", m.dir, m.share)
+	}
+
+	return withMountedShare(m.ctx, m.mounter, m.server, m.share, m.cr, func(mntPoint string) error {
+		return f(filepath.Join(mntPoint, m.dir))
+	})
+}
+
+// withMountedShare mounts share of server on the controller and calls f with the mount point.
+func withMountedShare(ctx context.Context, mounter mount.Interface, server, share string, cr *credentials, f func(mntPoint string) error) error {
+	if err := createPersistentStorage(controllerMountRoot); err != nil {
+		return fmt.Errorf("failed to create controller mount root: %v", err)
+	}
+
+	mntPoint, err := ioutil.TempDir(controllerMountRoot, share+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create mount point for share %s: %v", share, err)
+	}
+
+	if err = mountCifs(ctx, mounter, cifsSource(server, share, ""), mntPoint, cr, nil); err != nil {
+		os.Remove(mntPoint)
+		return err
+	}
+
+	defer func() {
+		if err := util.UnmountPath(mntPoint, mounter); err != nil {
+			glog.Errorf("cifs: failed to unmount share %s from %s: %v", share, mntPoint, err)
+		}
+	}()
+
+	return f(mntPoint)
+}
+
+func (m *subdirShareManager) createShare(s *shareInfo) error {
+	return m.withBaseShare(func(root string) error {
+		p, err := subdirPath(root, s.Name)
+		if err != nil {
+			return err
+		}
+
+		return os.MkdirAll(p, 0755)
+	})
+}
+
+func (m *subdirShareManager) deleteShare(name string) error {
+	return m.withBaseShare(func(root string) error {
+		p, err := subdirPath(root, name)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(p); os.IsNotExist(err) {
+			return errShareNotFound
+		}
+
+		if m.archiveOnDelete {
+			archived := filepath.Join(root, archivedSubdirPrefix+name)
+			glog.Infof("cifs: archiving %s to %s", p, archived)
+			return os.Rename(p, archived)
+		}
+
+		return os.RemoveAll(p)
+	})
+}
+
+func (m *subdirShareManager) getShare(name string) (*shareInfo, error) {
+	s := &shareInfo{Name: name, Path: path.Join(m.dir, name)}
+
+	err := m.withBaseShare(func(root string) error {
+		p, err := subdirPath(root, name)
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errShareNotFound
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", s.Path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (m *subdirShareManager) listShares() ([]string, error) {
+	var names []string
+
+	err := m.withBaseShare(func(root string) error {
+		fis, err := ioutil.ReadDir(root)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range fis {
+			if fi.IsDir() {
+				names = append(names, fi.Name())
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (m *subdirShareManager) setShareOptions(name string, opts map[string]string) error {
+	return fmt.Errorf("share options are not supported by %s share manager", subdirShareManagerName)
+}
+
+func (m *subdirShareManager) withShareDir(name string, f func(dir string) error) error {
+	return m.withBaseShare(func(root string) error {
+		dir, err := subdirPath(root, name)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(dir); err != nil {
+			if os.IsNotExist(err) {
+				return errShareNotFound
+			}
+			return err
+		}
+
+		return f(dir)
+	})
+}
+
+func (m *subdirShareManager) withRootDir(f func(dir string) error) error {
+	return m.withBaseShare(f)
+}
@@ -1,14 +1,21 @@
 package cifs
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
 func (cs *controllerServer) validateCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
@@ -20,6 +27,17 @@ func (cs *controllerServer) validateCreateVolumeRequest(req *csi.CreateVolumeReq
 		return status.Error(codes.InvalidArgument, "Volume Name cannot be empty")
 	}
 
+	switch src := req.GetVolumeContentSource(); {
+	case src.GetSnapshot() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+			return fmt.Errorf("invalid CreateVolumeRequest: %v", err)
+		}
+	case src.GetVolume() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CLONE_VOLUME); err != nil {
+			return fmt.Errorf("invalid CreateVolumeRequest: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -31,15 +49,143 @@ func (cs *controllerServer) validateDeleteVolumeRequest(req *csi.DeleteVolumeReq
 	return nil
 }
 
+func (cs *controllerServer) validateControllerExpandVolumeRequest(req *csi.ControllerExpandVolumeRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return fmt.Errorf("invalid ControllerExpandVolumeRequest: %v", err)
+	}
+
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	r := req.GetCapacityRange()
+	if r.GetRequiredBytes() == 0 && r.GetLimitBytes() == 0 {
+		return status.Error(codes.InvalidArgument, "capacity range missing in request")
+	}
+	if r.GetLimitBytes() != 0 && r.GetLimitBytes() < r.GetRequiredBytes() {
+		return status.Error(codes.InvalidArgument, "capacity limit is smaller than the required capacity")
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) validateCreateSnapshotRequest(req *csi.CreateSnapshotRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return fmt.Errorf("invalid CreateSnapshotRequest: %v", err)
+	}
+
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "snapshot name missing in request")
+	}
+
+	if req.GetSourceVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "source volume ID missing in request")
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) validateDeleteSnapshotRequest(req *csi.DeleteSnapshotRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return fmt.Errorf("invalid DeleteSnapshotRequest: %v", err)
+	}
+
+	if req.GetSnapshotId() == "" {
+		return status.Error(codes.InvalidArgument, "snapshot ID missing in request")
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) validateGetCapacityRequest(req *csi.GetCapacityRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		return fmt.Errorf("invalid GetCapacityRequest: %v", err)
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) validateListVolumesRequest(req *csi.ListVolumesRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return fmt.Errorf("invalid ListVolumesRequest: %v", err)
+	}
+
+	if req.GetMaxEntries() < 0 {
+		return status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) validateListSnapshotsRequest(req *csi.ListSnapshotsRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return fmt.Errorf("invalid ListSnapshotsRequest: %v", err)
+	}
+
+	if req.GetMaxEntries() < 0 {
+		return status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	return nil
+}
+
+func validateValidateVolumeCapabilitiesRequest(req *csi.ValidateVolumeCapabilitiesRequest) error {
+	if req.GetVolumeId() == "" {
+		return fmt.Errorf("volume ID missing in request")
+	}
+
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return fmt.Errorf("volume capabilities missing in request")
+	}
+
+	return nil
+}
+
+func validateNodeStageVolumeRequest(req *csi.NodeStageVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return fmt.Errorf("volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return fmt.Errorf("staging target path missing in request")
+	}
+
+	if req.GetVolumeCapability() == nil {
+		return fmt.Errorf("volume capability missing in request")
+	}
+
+	return nil
+}
+
+func validateNodeUnstageVolumeRequest(req *csi.NodeUnstageVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return fmt.Errorf("volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return fmt.Errorf("staging target path missing in request")
+	}
+
+	return nil
+}
+
 func validateNodePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
 	if req.GetVolumeId() == "" {
 		return fmt.Errorf("volume ID missing in request")
 	}
 
+	if req.GetStagingTargetPath() == "" {
+		return fmt.Errorf("staging target path missing in request")
+	}
+
 	if req.GetTargetPath() == "" {
 		return fmt.Errorf("varget path missing in request")
 	}
 
+	if req.GetVolumeCapability() == nil {
+		return fmt.Errorf("volume capability missing in request")
+	}
+
 	return nil
 }
 
@@ -55,9 +201,58 @@ func validateNodeUnpublishVolumeRequest(req *csi.NodeUnpublishVolumeRequest) err
 	return nil
 }
 
+func validateNodeGetVolumeStatsRequest(req *csi.NodeGetVolumeStatsRequest) error {
+	if req.GetVolumeId() == "" {
+		return fmt.Errorf("volume ID missing in request")
+	}
+
+	if req.GetVolumePath() == "" {
+		return fmt.Errorf("volume path missing in request")
+	}
+
+	return nil
+}
+
+// paginate returns the range of the n entries of a list to return for
+// startingToken and maxEntries, and the next token. Tokens are the index
+// of the first entry to return.
+func paginate(n int, startingToken string, maxEntries int32) (int, int, string, error) {
+	start := 0
+	if startingToken != "" {
+		i, err := strconv.Atoi(startingToken)
+		if err != nil || i < 0 || i > n {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+		start = i
+	}
+
+	end := n
+	if m := int(maxEntries); m > 0 && start+m < end {
+		end = start + m
+	}
+
+	next := ""
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+
+	return start, end, next, nil
+}
+
+// isReadOnlyAccessMode reports whether cap allows only reading the volume.
+func isReadOnlyAccessMode(cap *csi.VolumeCapability) bool {
+	switch cap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+
+	return false
+}
+
 type Interface interface {
-	execCommand() ([]byte, error)
-	execCommandAndValidate() error
+	execCommand(ctx context.Context) ([]byte, error)
+	execCommandAndValidate(ctx context.Context) error
 }
 
 var _ Interface = &fakeCommander{}
@@ -66,32 +261,146 @@ var _ Interface = &commander{}
 type commander struct {
 	cmd     string
 	options []string
+	// stdin is written to the standard input of the command, if not nil
+	stdin []byte
+	// env is added to the environment of the command
+	env []string
 }
 
 type fakeCommander struct {
 	commander
 }
 
-func (c *commander) execCommand() ([]byte, error) {
-	glog.V(4).Infof("cifs: EXEC %s %s", c.cmd, c.options)
+// commandTimeouts are the timeouts of the commands run by the driver, by
+// command name. Other commands, such as the cp of potentially large volumes,
+// are only bounded by the deadline of the request.
+var commandTimeouts = map[string]time.Duration{
+	"net":       2 * time.Minute,
+	"mount":     2 * time.Minute,
+	"xfs_quota": time.Minute,
+	"btrfs":     time.Minute,
+	"kinit":     time.Minute,
+}
+
+// SetCommandTimeouts overrides the timeouts of commands given as a comma
+// separated list of COMMAND=DURATION, such as "net=30s,cp=1h". A zero
+// duration removes the timeout of the command.
+func SetCommandTimeouts(spec string) error {
+	timeouts := make(map[string]time.Duration)
+	for _, kv := range strings.Split(spec, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid command timeout %q, expected COMMAND=DURATION", kv)
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration in command timeout %q", kv)
+		}
+		timeouts[parts[0]] = d
+	}
+
+	for cmd, d := range timeouts {
+		commandTimeouts[cmd] = d
+	}
+
+	return nil
+}
+
+// execCommand runs the command in its own process group, which is killed
+// when ctx is done or the command times out. Timeouts are reported as
+// DeadlineExceeded gRPC errors so that the COs retry the request.
+func (c *commander) execCommand(ctx context.Context) ([]byte, error) {
+	glog.V(4).Infof("cifs: EXEC %s %s", c.cmd, redactSecrets(strings.Join(c.options, " ")))
+
+	if d := commandTimeouts[c.cmd]; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	var out bytes.Buffer
 
 	cmd := exec.Command(c.cmd, c.options...)
-	return cmd.CombinedOutput()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if c.stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.stdin)
+	}
+	if c.env != nil {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+	}
+
+	// Children such as mount.cifs run by mount would keep running otherwise
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		glog.Errorf("cifs: failed to kill %s: %v", c.cmd, err)
+	}
+	<-done
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.Bytes(), status.Errorf(codes.DeadlineExceeded, "%s timed out", c.cmd)
+	}
+	return out.Bytes(), status.Errorf(codes.Canceled, "%s canceled: %v", c.cmd, ctx.Err())
 }
 
-func (c *commander) execCommandAndValidate() error {
-	out, err := c.execCommand()
+func (c *commander) execCommandAndValidate(ctx context.Context) error {
+	out, err := c.execCommand(ctx)
 	if err != nil {
-		return fmt.Errorf("cifs: %s failed with following error: %s\ncifs: %s output: %s", c.cmd, err, c.cmd, out)
+		return commandError(c.cmd, err, out)
 	}
 
 	return nil
 }
 
-func (c *fakeCommander) execCommandAndValidate() error {
+// commandError describes the failure of cmd with output out as an Internal
+// gRPC error. gRPC errors, such as the ones of timed out commands, are
+// returned as is.
+func commandError(cmd string, err error, out []byte) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Error(codes.Internal, commandErrorMessage(cmd, err, out))
+}
+
+func commandErrorMessage(cmd string, err error, out []byte) string {
+	return fmt.Sprintf("cifs: %s failed with following error: %s\ncifs: %s output: %s", cmd, err, cmd, redactSecrets(string(out)))
+}
+
+// statusError returns err as a gRPC error with code, unless it already is
+// a gRPC error such as the DeadlineExceeded error of a timed out command.
+func statusError(code codes.Code, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Error(code, err.Error())
+}
+
+func (c *fakeCommander) execCommandAndValidate(ctx context.Context) error {
 	return nil
 }
 
-func (c *fakeCommander) execCommand() ([]byte, error) {
+func (c *fakeCommander) execCommand(ctx context.Context) ([]byte, error) {
 	return nil, nil
 }
@@ -0,0 +1,104 @@
+package cifs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCommanderExecCommand(t *testing.T) {
+	defer func(timeout time.Duration) { commandTimeouts["sh"] = timeout }(commandTimeouts["sh"])
+	commandTimeouts["sh"] = 200 * time.Millisecond
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		args []string
+		out  string
+		code codes.Code
+	}{
+		{name: "Success", ctx: context.Background(), args: []string{"-c", "echo ok"}, out: "ok\n", code: codes.OK},
+		{name: "Fail due to timeout", ctx: context.Background(), args: []string{"-c", "sleep 10"}, code: codes.DeadlineExceeded},
+		{name: "Fail due to timed out child", ctx: context.Background(), args: []string{"-c", "sleep 10 & wait"}, code: codes.DeadlineExceeded},
+		{name: "Fail due to canceled request", ctx: canceled, args: []string{"-c", "sleep 10"}, code: codes.Canceled},
+	}
+
+	for _, tc := range tests {
+		start := time.Now()
+		out, err := (&commander{cmd: "sh", options: tc.args}).execCommand(tc.ctx)
+
+		if tc.code == codes.OK {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			} else if string(out) != tc.out {
+				t.Errorf("%s: expected output %q, but got %q", tc.name, tc.out, string(out))
+			}
+			continue
+		}
+
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: expected the command to be killed, but it ran for %v", tc.name, d)
+		}
+	}
+}
+
+func TestSetCommandTimeouts(t *testing.T) {
+	defer func(net, cp time.Duration) {
+		commandTimeouts["net"] = net
+		commandTimeouts["cp"] = cp
+	}(commandTimeouts["net"], commandTimeouts["cp"])
+
+	tests := []struct {
+		name   string
+		spec   string
+		errors bool
+	}{
+		{name: "Success", spec: "net=30s, cp=1h", errors: false},
+		{name: "Success with empty spec", spec: "", errors: false},
+		{name: "Fail due to missing duration", spec: "net", errors: true},
+		{name: "Fail due to invalid duration", spec: "net=soon", errors: true},
+		{name: "Fail due to negative duration", spec: "net=-1s", errors: true},
+	}
+
+	for _, tc := range tests {
+		err := SetCommandTimeouts(tc.spec)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+
+	if commandTimeouts["net"] != 30*time.Second || commandTimeouts["cp"] != time.Hour {
+		t.Errorf("expected net=30s and cp=1h, but got %v", commandTimeouts)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "Plain error", err: errors.New("failed"), code: codes.Internal},
+		{name: "gRPC error", err: status.Error(codes.DeadlineExceeded, "net timed out"), code: codes.DeadlineExceeded},
+		{name: "Command error", err: commandError("net", status.Error(codes.DeadlineExceeded, "net timed out"), nil), code: codes.DeadlineExceeded},
+	}
+
+	for _, tc := range tests {
+		if code := status.Code(statusError(codes.Internal, tc.err)); code != tc.code {
+			t.Errorf("%s: expected code %v, but got %v", tc.name, tc.code, code)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package cifs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// Volume IDs encode where the volume is exported so that the volume can be
+// deleted and mounted without any local state:
+//
+//	csi-cifs-v1#SHARE_MANAGER#SERVER#SHARE#SUBDIR#QUOTA_MANAGER#PATH_HASH#FLAGS
+//
+// Each field is query-escaped and FLAGS is a comma-separated list of flags.
+// The path of net shares is only encoded as a hash, so that IDs stay within
+// the CSI limit of 128 bytes, and is read from the controller cache or from
+// the share on the server. The path of subdirectories is restored from SUBDIR.
+//
+// IDs without a version prefix, such as the legacy csi-cifs-UUID ones, are
+// looked up in the controller cache, which takes precedence for the volumes
+// it holds.
+const (
+	volumeIDPrefix    = "csi-cifs-"
+	volumeIDVersion   = "v1"
+	volumeIDSeparator = "#"
+
+	volumeIDFields = 8
+
+	volumeIDFlagArchive = "archive"
+
+	// maxIDLength is the maximum length of volume and snapshot IDs allowed by CSI
+	maxIDLength = 128
+)
+
+// errVolumeNotFound is returned when an unversioned volume ID is not found in the controller cache.
+var errVolumeNotFound = errors.New("volume not found")
+
+// volumeIDNamespace is the UUID namespace of share names.
+var volumeIDNamespace = uuid.NewSHA1(uuid.NameSpace_URL, []byte("https://github.com/alternative-storage/cifs-csi"))
+
+// newShareName returns the name of the share or subdirectory which backs the volume named name.
+// It is derived from the name so that retried CreateVolume calls map to the same share.
+func newShareName(name string) string {
+	return volumeIDPrefix + uuid.NewSHA1(volumeIDNamespace, []byte(name)).String()
+}
+
+// hashPath returns the hash of the path p which volume IDs hold, or "" if p is empty.
+func hashPath(p string) string {
+	if p == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(path.Clean(p)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newVolumeID returns the volume ID of the volume exported as described by volOptions.
+func newVolumeID(volOptions *volumeOptions) volumeID {
+	var flags []string
+	if volOptions.ArchiveOnDelete {
+		flags = append(flags, volumeIDFlagArchive)
+	}
+
+	sm := volOptions.ShareManager
+	if sm == "" {
+		sm = defaultShareManager
+	}
+
+	// The path of subdirectories is restored from SUBDIR
+	var pathHash string
+	if sm != subdirShareManagerName {
+		pathHash = volOptions.pathHash()
+	}
+
+	fields := []string{
+		volumeIDPrefix + volumeIDVersion,
+		url.QueryEscape(sm),
+		url.QueryEscape(volOptions.Server),
+		url.QueryEscape(volOptions.Share),
+		url.QueryEscape(volOptions.Subdir),
+		url.QueryEscape(volOptions.QuotaManager),
+		pathHash,
+		url.QueryEscape(strings.Join(flags, ",")),
+	}
+
+	return volumeID(strings.Join(fields, volumeIDSeparator))
+}
+
+// isVersionedVolumeID reports whether volId was created by newVolumeID.
+func isVersionedVolumeID(volId volumeID) bool {
+	return strings.HasPrefix(string(volId), volumeIDPrefix+volumeIDVersion+volumeIDSeparator)
+}
+
+// decodeVolumeID returns the volume options encoded in the versioned volume
+// ID volId. The options of net volumes hold the hash of their path in
+// PathHash instead of the path.
+func decodeVolumeID(volId volumeID) (*volumeOptions, error) {
+	if !isVersionedVolumeID(volId) {
+		return nil, fmt.Errorf("volume ID %s is not a versioned volume ID", volId)
+	}
+
+	fields := strings.Split(string(volId), volumeIDSeparator)
+	if len(fields) != volumeIDFields {
+		return nil, fmt.Errorf("malformed volume ID %s: expected %d fields, got %d", volId, volumeIDFields, len(fields))
+	}
+
+	for i := range fields {
+		f, err := url.QueryUnescape(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed volume ID %s: %v", volId, err)
+		}
+		fields[i] = f
+	}
+
+	o := &volumeOptions{
+		ShareManager: fields[1],
+		Server:       fields[2],
+		Share:        fields[3],
+		Subdir:       fields[4],
+		QuotaManager: fields[5],
+		PathHash:     fields[6],
+	}
+
+	if flags := fields[7]; flags != "" {
+		for _, flag := range strings.Split(flags, ",") {
+			switch flag {
+			case volumeIDFlagArchive:
+				o.ArchiveOnDelete = true
+			default:
+				return nil, fmt.Errorf("malformed volume ID %s: unknown flag %q", volId, flag)
+			}
+		}
+	}
+
+	if _, ok := shareManagers[o.ShareManager]; !ok {
+		return nil, fmt.Errorf("malformed volume ID %s: unknown share manager %q", volId, o.ShareManager)
+	}
+	if o.Server == "" || o.Share == "" {
+		return nil, fmt.Errorf("malformed volume ID %s: missing server or share", volId)
+	}
+	if _, ok := quotaManagers[o.QuotaManager]; o.QuotaManager != "" && !ok {
+		return nil, fmt.Errorf("malformed volume ID %s: unknown quota manager %q", volId, o.QuotaManager)
+	}
+	if (o.ShareManager == subdirShareManagerName) != (o.Subdir != "") {
+		return nil, fmt.Errorf("malformed volume ID %s: subdirectory doesn't match share manager %s", volId, o.ShareManager)
+	}
+	if b, err := hex.DecodeString(o.PathHash); o.PathHash != "" && (err != nil || len(b) != 8) {
+		return nil, fmt.Errorf("malformed volume ID %s: invalid path hash %q", volId, o.PathHash)
+	}
+	if o.Subdir != "" && o.PathHash != "" {
+		return nil, fmt.Errorf("malformed volume ID %s: unexpected path hash of subdirectory", volId)
+	}
+	if o.Subdir != "" && (!isRelativeSubdir(o.Subdir) || !isSubdirName(path.Base(o.Subdir))) {
+		return nil, fmt.Errorf("malformed volume ID %s: subdirectory %q is outside of share %s", volId, o.Subdir, o.Share)
+	}
+
+	if o.Subdir != "" {
+		o.Path = path.Dir(o.Subdir)
+		if o.Path == "." {
+			o.Path = ""
+		}
+	}
+
+	return o, nil
+}
+
+// getVolumeOptions returns the options of the volume volId, reading them
+// from the controller cache, which also holds the options which aren't
+// encoded in volume IDs such as dfreeCommand, or decoding them from the
+// volume ID otherwise. The path of decoded net volumes is taken from the
+// cached volumes with the same path, if any. Unversioned volume IDs are only
+// found in the cache.
+func getVolumeOptions(volId volumeID) (*volumeOptions, error) {
+	if ent, ok := ctrCache.get(volId); ok {
+		o := ent.VolOptions
+		return &o, nil
+	}
+
+	if !isVersionedVolumeID(volId) {
+		return nil, errVolumeNotFound
+	}
+
+	o, err := decodeVolumeID(volId)
+	if err != nil {
+		return nil, err
+	}
+
+	resolveCachedPath(o)
+
+	return o, nil
+}
+
+// resolveCachedPath sets the path of the volume options o, which only hold
+// its hash, to the path of the cached volumes with the same path, if any.
+func resolveCachedPath(o *volumeOptions) {
+	if o.PathHash == "" {
+		return
+	}
+
+	for _, ent := range ctrCache.list() {
+		vo := &ent.VolOptions
+		if vo.ShareManager == o.ShareManager && vo.Server == o.Server && vo.Path != "" && hashPath(vo.Path) == o.PathHash {
+			o.Path, o.PathHash = vo.Path, ""
+			return
+		}
+	}
+}
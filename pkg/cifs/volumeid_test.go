@@ -0,0 +1,131 @@
+package cifs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVolumeID(t *testing.T) {
+	tests := []struct {
+		name       string
+		volOptions *volumeOptions
+	}{
+		{
+			name:       "net",
+			volOptions: &volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testvol"},
+		},
+		{
+			name:       "subdir",
+			volOptions: &volumeOptions{ShareManager: "subdir", Server: "fs#1.example.com", Share: "vols", Subdir: "k8s/csi-cifs-testvol", Path: "k8s"},
+		},
+		{
+			name:       "net with quota",
+			volOptions: &volumeOptions{ShareManager: "net", Server: "192.168.122.1", Share: "csi-cifs-testvol", Path: "/srv/samba,1", QuotaManager: "xfs"},
+		},
+		{
+			name:       "subdir with archive",
+			volOptions: &volumeOptions{ShareManager: "subdir", Server: "[fe80::1]", Share: "my share", Subdir: "csi-cifs-testvol", ArchiveOnDelete: true},
+		},
+		{
+			name:       "net with long path",
+			volOptions: &volumeOptions{ShareManager: "net", Server: "fileserver01.example.com", Share: newShareName("pvc-3c9e4c5f-3a5e-11e9-b210-d663bd873d93"), Path: "/srv/samba/kubernetes/persistent-volumes/production", QuotaManager: "dfree"},
+		},
+	}
+
+	for _, tc := range tests {
+		volId := newVolumeID(tc.volOptions)
+		if !isVersionedVolumeID(volId) {
+			t.Errorf("%s: expected %s to be a versioned volume ID", tc.name, volId)
+		}
+		if len(volId) > maxIDLength {
+			t.Errorf("%s: expected volume ID %s to be at most %d bytes, but got %d", tc.name, volId, maxIDLength, len(volId))
+		}
+
+		// Only the hash of the path of net volumes is encoded
+		exp := *tc.volOptions
+		if exp.ShareManager != subdirShareManagerName && exp.Path != "" {
+			exp.Path, exp.PathHash = "", hashPath(exp.Path)
+		}
+
+		o, err := decodeVolumeID(volId)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, &exp) {
+			t.Errorf("%s: expected %+v, but got %+v", tc.name, &exp, o)
+		}
+	}
+}
+
+func TestDecodeVolumeID(t *testing.T) {
+	tests := []struct {
+		name   string
+		volId  volumeID
+		errors bool
+	}{
+		{name: "Success", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol####", errors: false},
+		{name: "Fail due to legacy volume ID", volId: "csi-cifs-9bd0415d-c226-11e8-8086-54e1ad486e52", errors: true},
+		{name: "Fail due to missing fields", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol##", errors: true},
+		{name: "Fail due to missing server", volId: "csi-cifs-v1#net##csi-cifs-testvol####", errors: true},
+		{name: "Fail due to unknown share manager", volId: "csi-cifs-v1#foo#192.168.122.1#csi-cifs-testvol####", errors: true},
+		{name: "Fail due to missing subdir", volId: "csi-cifs-v1#subdir#192.168.122.1#vols####", errors: true},
+		{name: "Fail due to unknown flag", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol####foo", errors: true},
+		{name: "Success with quota", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol##xfs#3c37ed948a1169e2#", errors: false},
+		{name: "Fail due to unknown quota manager", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol##foo##", errors: true},
+		{name: "Fail due to invalid path hash", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-testvol##xfs#%2Fsrv%2Fsamba#", errors: true},
+		{name: "Fail due to path hash of subdir", volId: "csi-cifs-v1#subdir#192.168.122.1#vols#k8s%2Fcsi-cifs-testvol##3c37ed948a1169e2#", errors: true},
+		{name: "Success with subdir", volId: "csi-cifs-v1#subdir#192.168.122.1#vols#k8s%2Fcsi-cifs-testvol###", errors: false},
+		{name: "Fail due to subdir outside of share", volId: "csi-cifs-v1#subdir#192.168.122.1#vols#..%2F..%2Fetc###", errors: true},
+		{name: "Fail due to absolute subdir", volId: "csi-cifs-v1#subdir#192.168.122.1#vols#%2Fetc###", errors: true},
+		{name: "Fail due to subdir of path", volId: "csi-cifs-v1#subdir#192.168.122.1#vols#k8s%2F..###", errors: true},
+		{name: "Fail due to bad escape", volId: "csi-cifs-v1#net#192.168.122.1#csi-cifs-%zz####", errors: true},
+	}
+
+	for _, tc := range tests {
+		_, err := decodeVolumeID(tc.volId)
+		if err != nil && !tc.errors {
+			t.Errorf("%s: unexpected error %v", tc.name, err.Error())
+		}
+		if err == nil && tc.errors {
+			t.Errorf("%s: expected error, but not got any error", tc.name)
+		}
+	}
+}
+
+func TestGetVolumeOptions(t *testing.T) {
+	volOptions := &volumeOptions{ShareManager: "net", Server: "192.168.122.1", Path: "/srv/samba", QuotaManager: "dfree", DfreeCommand: "/usr/bin/dfree"}
+	volOptions.assignShare("csi-cifs-testvol")
+	volId := newVolumeID(volOptions)
+
+	// The dfree command isn't encoded in the volume ID
+	o, err := getVolumeOptions(volId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if o.DfreeCommand != "" {
+		t.Errorf("expected no dfree command, but got %q", o.DfreeCommand)
+	}
+
+	if err = ctrCache.insert(&controllerCacheEntry{VolOptions: *volOptions, VolumeID: volId}); err != nil {
+		t.Fatalf("failed to insert cache entry: %v", err)
+	}
+	defer ctrCache.pop(volId)
+
+	if o, err = getVolumeOptions(volId); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(o, volOptions) {
+		t.Errorf("expected options %+v from the cache, but got %+v", volOptions, o)
+	}
+
+	// The path of other volumes with the same path is taken from the cache
+	other := *volOptions
+	other.assignShare("csi-cifs-othervol")
+	if o, err = getVolumeOptions(newVolumeID(&other)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if o.Path != volOptions.Path || o.PathHash != "" {
+		t.Errorf("expected path %s, but got %q with hash %q", volOptions.Path, o.Path, o.PathHash)
+	}
+}
@@ -2,11 +2,23 @@ package cifs
 
 import (
 	"errors"
+	"path"
+	"strconv"
 )
 
 type volumeOptions struct {
-	Server string `json:"server"`
-	Share  string `json:"share"`
+	Server          string `json:"server"`
+	Share           string `json:"share"`
+	Subdir          string `json:"subdir"`
+	Path            string `json:"path"`
+	ShareManager    string `json:"shareManager"`
+	ArchiveOnDelete bool   `json:"archiveOnDelete"`
+	QuotaManager    string `json:"quotaManager"`
+	DfreeCommand    string `json:"dfreeCommand"`
+
+	// PathHash is the hash of the path of net volumes whose options were
+	// decoded from a volume ID, while Path is unknown
+	PathHash string `json:"-"`
 }
 
 func extractOption(dest *string, optionLabel string, options map[string]string) error {
@@ -18,6 +30,24 @@ func extractOption(dest *string, optionLabel string, options map[string]string)
 	}
 }
 
+func extractOptionalOption(dest *string, optionLabel string, options map[string]string) {
+	if opt, ok := options[optionLabel]; ok {
+		*dest = opt
+	}
+}
+
+func extractOptionalBoolOption(dest *bool, optionLabel string, options map[string]string) error {
+	if opt, ok := options[optionLabel]; ok {
+		b, err := strconv.ParseBool(opt)
+		if err != nil {
+			return errors.New("Invalid value for field " + optionLabel + ": " + opt)
+		}
+		*dest = b
+	}
+
+	return nil
+}
+
 func newVolumeOptions(volOptions map[string]string) (*volumeOptions, error) {
 	var (
 		opts volumeOptions
@@ -28,5 +58,96 @@ func newVolumeOptions(volOptions map[string]string) (*volumeOptions, error) {
 		return nil, err
 	}
 
+	extractOptionalOption(&opts.Path, "path", volOptions)
+
+	opts.ShareManager = defaultShareManager
+	extractOptionalOption(&opts.ShareManager, "shareManager", volOptions)
+
+	if _, err = getMountOptions(volOptions, nil); err != nil {
+		return nil, err
+	}
+
+	switch opts.ShareManager {
+	case netShareManagerName:
+	case subdirShareManagerName:
+		if err = extractOption(&opts.Share, "share", volOptions); err != nil {
+			return nil, err
+		}
+		if !isRelativeSubdir(opts.Path) {
+			return nil, errors.New("path " + opts.Path + " has to be relative to share " + opts.Share + " and stay within it")
+		}
+		if err = extractOptionalBoolOption(&opts.ArchiveOnDelete, "archiveOnDelete", volOptions); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unknown shareManager " + opts.ShareManager)
+	}
+
+	extractOptionalOption(&opts.QuotaManager, "quotaManager", volOptions)
+
+	switch opts.QuotaManager {
+	case "", noQuotaManagerName:
+		// Volume IDs don't record the absence of a quota
+		opts.QuotaManager = ""
+	case xfsQuotaManagerName:
+		if opts.ShareManager != netShareManagerName {
+			return nil, errors.New("quotaManager " + opts.QuotaManager + " requires shareManager " + netShareManagerName)
+		}
+		if !path.IsAbs(opts.Path) {
+			return nil, errors.New("quotaManager " + opts.QuotaManager + " requires an absolute path")
+		}
+	case dfreeQuotaManagerName:
+		if opts.ShareManager != netShareManagerName {
+			return nil, errors.New("quotaManager " + opts.QuotaManager + " requires shareManager " + netShareManagerName)
+		}
+		extractOptionalOption(&opts.DfreeCommand, "dfreeCommand", volOptions)
+	default:
+		return nil, errors.New("Unknown quotaManager " + opts.QuotaManager)
+	}
+
 	return &opts, nil
 }
+
+// assignShare sets the share and the subdirectory which back the volume,
+// given the name of the share or subdirectory to create.
+func (o *volumeOptions) assignShare(shareName string) {
+	if o.ShareManager == subdirShareManagerName {
+		o.Subdir = path.Join(o.Path, shareName)
+	} else {
+		o.Share = shareName
+	}
+}
+
+// shareName returns the name of the share or subdirectory which backs the volume.
+func (o *volumeOptions) shareName() string {
+	if o.ShareManager == subdirShareManagerName {
+		return path.Base(o.Subdir)
+	}
+
+	return o.Share
+}
+
+// pathHash returns the hash of the path of the volume.
+func (o *volumeOptions) pathHash() string {
+	if o.Path == "" {
+		return o.PathHash
+	}
+
+	return hashPath(o.Path)
+}
+
+// volumeContext returns the volume context which is passed to the node
+// plugin to mount the volume.
+func (o *volumeOptions) volumeContext(params map[string]string) map[string]string {
+	volCtx := make(map[string]string, len(params)+2)
+	for k, v := range params {
+		volCtx[k] = v
+	}
+
+	volCtx["share"] = o.Share
+	if o.Subdir != "" {
+		volCtx["subdir"] = o.Subdir
+	}
+
+	return volCtx
+}